@@ -9,6 +9,8 @@ import "unsafe"
 import "github.com/stouset/go.noise/ciphersuite"
 
 import "encoding/binary"
+import "errors"
+import "time"
 
 func shutBox(
 	suite ciphersuite.Ciphersuite,
@@ -19,7 +21,9 @@ func shutBox(
 	cv *ciphersuite.ChainVariable,
 	kdfNum int8,
 	padLen uint32,
+	validity *validityPeriod,
 	data []byte,
+	ad []byte,
 ) (
 	box []byte,
 ) {
@@ -32,7 +36,7 @@ func shutBox(
 	*cv, cc2 = suite.DeriveCVCC(*cv, dh2, kdfNum+1)
 
 	header := shutBoxHeader(suite, cc1, selfEphemeralKey.Public, selfKey.Public)
-	body := shutBoxBody(suite, cc2, selfEphemeralKey.Public, header, data, padLen)
+	body := shutBoxBody(suite, cc2, selfEphemeralKey.Public, header, data, ad, padLen, validity)
 
 	box = make(
 		[]byte,
@@ -63,7 +67,9 @@ func shutBoxBody(
 	selfEphemeralPublicKey ciphersuite.PublicKey,
 	header []byte,
 	data []byte,
+	ad []byte,
 	padLen uint32,
+	validity *validityPeriod,
 ) (
 	body []byte,
 ) {
@@ -76,15 +82,27 @@ func shutBoxBody(
 		C.randombytes(randomPtr, randomLen)
 	}
 
-	plaintext := make([]byte, len(data)+int(padLen)+4)
+	trailer := padLen
+	trailerLen := 4
+
+	if validity != nil {
+		trailer |= validityFlag
+		trailerLen += validityLen
+	}
+
+	plaintext := make([]byte, len(data)+int(padLen)+trailerLen)
 	copy(plaintext, data)
 	copy(plaintext[len(data):], random)
-	binary.LittleEndian.PutUint32(plaintext[len(data)+len(random):], padLen)
+	binary.LittleEndian.PutUint32(plaintext[len(plaintext)-4:], trailer)
+
+	if validity != nil {
+		validity.put(plaintext[len(plaintext)-4-validityLen:])
+	}
 
 	return suite.Encrypt(
 		cc,
 		plaintext,
-		append(selfEphemeralPublicKey, header...),
+		boxAuthtext(selfEphemeralPublicKey, header, ad),
 	)
 }
 
@@ -97,15 +115,21 @@ func openBox(
 	cv *ciphersuite.ChainVariable,
 	kdfNum int8,
 	box []byte,
+	ad []byte,
 ) (
 	data []byte,
+	validity *validityPeriod,
 	err error,
 ) {
 	var cc1, cc2 ciphersuite.CipherContext
 
-	*peerEphemeralKey = box[:suite.DHLen()]
-	header := box[suite.DHLen() : suite.DHLen()+suite.DHLen()+suite.MACLen()]
-	body := box[suite.DHLen()+suite.DHLen()+suite.MACLen():]
+	eph, header, body, err := splitBox(suite, box)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	*peerEphemeralKey = eph
 
 	dh1 := suite.DH(selfEphemeralKey.Private, *peerEphemeralKey)
 	*cv, cc1 = suite.DeriveCVCC(*cv, dh1, kdfNum)
@@ -113,21 +137,66 @@ func openBox(
 	*peerKey, err = openBoxHeader(suite, cc1, *peerEphemeralKey, header)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	dh2 := suite.DH(selfEphemeralKey.Private, *peerKey)
 	*cv, cc2 = suite.DeriveCVCC(*cv, dh2, kdfNum+1)
 
-	data, err = openBoxBody(suite, cc2, peerEphemeralKey, header, body)
+	data, validity, err = openBoxBody(suite, cc2, peerEphemeralKey, header, body, ad)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	return
 }
 
+// Reports whether a box's header can be decrypted by selfEphemeralKey
+// from a fresh chain, without otherwise opening it.
+func matchBoxHeader(
+	suite ciphersuite.Ciphersuite,
+	selfEphemeralKey *ciphersuite.Keypair,
+	kdfNum int8,
+	box []byte,
+) (
+	ok bool,
+) {
+	peerEphemeralKey, header, _, err := splitBox(suite, box)
+
+	if err != nil {
+		return false
+	}
+
+	dh := suite.DH(selfEphemeralKey.Private, peerEphemeralKey)
+	_, cc := suite.DeriveCVCC(suite.NewChain(), dh, kdfNum)
+
+	_, err = openBoxHeader(suite, cc, peerEphemeralKey, header)
+
+	return err == nil
+}
+
+func splitBox(
+	suite ciphersuite.Ciphersuite,
+	box []byte,
+) (
+	peerEphemeralKey ciphersuite.PublicKey,
+	header []byte,
+	body []byte,
+	err error,
+) {
+	var (
+		headerOffset = suite.DHLen()
+		bodyOffset   = headerOffset + suite.DHLen() + suite.MACLen()
+	)
+
+	if len(box) < bodyOffset+suite.MACLen() {
+		return nil, nil, nil, errShortBox
+	}
+
+	return box[:headerOffset], box[headerOffset:bodyOffset], box[bodyOffset:], nil
+}
+
 func openBoxHeader(
 	suite ciphersuite.Ciphersuite,
 	cc []byte,
@@ -146,21 +215,90 @@ func openBoxBody(
 	peerEphemeralKey *ciphersuite.PublicKey,
 	header []byte,
 	body []byte,
+	ad []byte,
 ) (
 	data []byte,
+	validity *validityPeriod,
 	err error,
 ) {
 	plaintext, err := suite.Decrypt(
 		cc,
 		body,
-		append(*peerEphemeralKey, header...),
+		boxAuthtext(*peerEphemeralKey, header, ad),
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if len(plaintext) < 4 {
+		return nil, nil, errMalformedBody
+	}
+
+	trailer := binary.LittleEndian.Uint32(plaintext[len(plaintext)-4:])
+	trailerLen := 4
+
+	if trailer&validityFlag != 0 {
+		trailerLen += validityLen
+	}
+
+	padLen := int(trailer &^ validityFlag)
+
+	if len(plaintext) < trailerLen+padLen {
+		return nil, nil, errMalformedBody
+	}
+
+	if trailer&validityFlag != 0 {
+		validity = getValidity(plaintext[len(plaintext)-trailerLen:])
 	}
 
-	padLen := binary.LittleEndian.Uint32(plaintext[len(plaintext)-4:])
+	return plaintext[:len(plaintext)-trailerLen-padLen], validity, nil
+}
 
-	return plaintext[:len(plaintext)-int(padLen)-4], nil
+var (
+	errShortBox      = errors.New("noise/box: box is too short")
+	errMalformedBody = errors.New("noise/box: box body is malformed")
+)
+
+// The high bit of the trailing padLen field marks a body that carries
+// a creation and expiry time between the padding and the padLen.
+const (
+	validityFlag = 1 << 31
+	validityLen  = 16
+)
+
+type validityPeriod struct {
+	created time.Time
+	expires time.Time
+}
+
+func (v *validityPeriod) put(dst []byte) {
+	binary.LittleEndian.PutUint64(dst[0:], uint64(v.created.Unix()))
+	binary.LittleEndian.PutUint64(dst[8:], uint64(v.expires.Unix()))
+}
+
+func getValidity(src []byte) *validityPeriod {
+	return &validityPeriod{
+		created: time.Unix(int64(binary.LittleEndian.Uint64(src[0:])), 0),
+		expires: time.Unix(int64(binary.LittleEndian.Uint64(src[8:])), 0),
+	}
+}
+
+// Builds the authtext for a box body. The ephemeral key and header
+// are fixed-length, so appending caller-supplied associated data after
+// them can't be confused with a different split of the same bytes.
+func boxAuthtext(
+	ephemeralPublicKey ciphersuite.PublicKey,
+	header []byte,
+	ad []byte,
+) (
+	authtext []byte,
+) {
+	authtext = make([]byte, len(ephemeralPublicKey)+len(header)+len(ad))
+
+	copy(authtext[0:], ephemeralPublicKey)
+	copy(authtext[len(ephemeralPublicKey):], header)
+	copy(authtext[len(ephemeralPublicKey)+len(header):], ad)
+
+	return
 }
@@ -0,0 +1,344 @@
+package box
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stouset/go.noise/ciphersuite"
+)
+
+var suite = ciphersuite.Noise255
+
+func newContextPair() (sender *Context, recipient *Context) {
+	var (
+		senderKey    = suite.NewKeypair()
+		recipientKey = suite.NewKeypair()
+	)
+
+	sender = NewContext(suite, &senderKey, 1)
+	recipient = NewContext(suite, &recipientKey, 1)
+
+	sender.Init(recipient.EphemeralPublicKey())
+
+	return
+}
+
+func TestOpenWithAssociatedData(t *testing.T) {
+	var (
+		sender, recipient = newContextPair()
+
+		data = []byte("data")
+		ad   = []byte("ad")
+	)
+
+	box, _ := sender.Shut(data, ad, 1, 0)
+	out, err := recipient.Open(box, ad, 1)
+
+	if err != nil {
+		t.Fatalf("Open(box, %q, 1) = %v; want nil", ad, err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Errorf("Open(box, %q, 1) = %q; want %q", ad, out, data)
+	}
+}
+
+func TestOpenWithMismatchedAssociatedData(t *testing.T) {
+	var (
+		sender, recipient = newContextPair()
+
+		data = []byte("data")
+	)
+
+	box, _ := sender.Shut(data, []byte("ad"), 1, 0)
+
+	if _, err := recipient.Open(box, []byte("other"), 1); err == nil {
+		t.Error("Open(box, \"other\", 1) = nil; want error")
+	}
+}
+
+func TestShutPaddingTooLong(t *testing.T) {
+	sender, _ := newContextPair()
+
+	if _, err := sender.Shut([]byte("data"), nil, 1, 1<<31); err != ErrPadding {
+		t.Errorf("Shut(padLen = 2^31) = %v; want %v", err, ErrPadding)
+	}
+}
+
+func TestOpenReplayLeavesState(t *testing.T) {
+	var (
+		senderKey    = suite.NewKeypair()
+		recipientKey = suite.NewKeypair()
+		sender       = NewContext(suite, &senderKey, 1)
+		guard        = NewMemoryReplayCache(16, 0)
+
+		first  = NewRecipientContext(suite, &recipientKey)
+		second = NewRecipientContext(suite, &recipientKey)
+	)
+
+	sender.Init(recipientKey.Public)
+	first.SetReplayGuard(guard)
+	second.SetReplayGuard(guard)
+
+	box, _ := sender.Shut([]byte("data"), nil, 1, 0)
+
+	if _, err := first.Open(box, nil, 1); err != nil {
+		t.Fatalf("Open(box) = %v; want nil", err)
+	}
+
+	cv := append(ciphersuite.ChainVariable(nil), second.cv...)
+
+	if _, err := second.Open(box, nil, 1); err != ErrReplay {
+		t.Fatalf("Open(replayed) = %v; want %v", err, ErrReplay)
+	}
+
+	if !bytes.Equal(second.cv, cv) || len(second.PeerPublicKey()) != 0 {
+		t.Error("Open(replayed) changed the context's state")
+	}
+}
+
+func TestOpenExpiredBox(t *testing.T) {
+	var (
+		sender, recipient = newContextPair()
+
+		now = time.Unix(1000000, 0)
+	)
+
+	sender.SetClock(func() time.Time { return now }, 0)
+	sender.SetLifetime(time.Minute)
+
+	recipient.SetClock(func() time.Time { return now.Add(time.Hour) }, time.Second)
+
+	box, _ := sender.Shut([]byte("data"), nil, 1, 0)
+
+	if _, err := recipient.Open(box, nil, 1); err != ErrExpired {
+		t.Errorf("Open(expired) = %v; want %v", err, ErrExpired)
+	}
+}
+
+func TestOpenBoxValidity(t *testing.T) {
+	var (
+		sender, recipient = newContextPair()
+
+		now  = time.Unix(1000000, 0)
+		data = []byte("data")
+	)
+
+	sender.SetClock(func() time.Time { return now }, 0)
+	sender.SetLifetime(time.Minute)
+
+	recipient.SetClock(func() time.Time { return now.Add(time.Second) }, 0)
+
+	box, _ := sender.Shut(data, nil, 1, 3)
+	out, err := recipient.Open(box, nil, 1)
+
+	if err != nil {
+		t.Fatalf("Open(box) = %v; want nil", err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Errorf("Open(box) = %q; want %q", out, data)
+	}
+
+	if created, expires := recipient.Validity(); !created.Equal(now) || !expires.Equal(now.Add(time.Minute)) {
+		t.Errorf("Validity() = %v, %v; want %v, %v", created, expires, now, now.Add(time.Minute))
+	}
+}
+
+func TestOpenEnvelope(t *testing.T) {
+	var (
+		senderKey    = suite.NewKeypair()
+		recipientKey = suite.NewKeypair()
+		sender       = NewContext(suite, &senderKey, 1)
+
+		data = []byte("data")
+	)
+
+	sender.Init(recipientKey.Public)
+
+	envelope, _ := sender.ShutEnvelope(data, nil, 1, 0)
+	ctx, out, err := OpenEnvelope(&recipientKey, envelope, nil, 1)
+
+	if err != nil {
+		t.Fatalf("OpenEnvelope(envelope) = %v; want nil", err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Errorf("OpenEnvelope(envelope) = %q; want %q", out, data)
+	}
+
+	if !bytes.Equal(ctx.PeerPublicKey(), senderKey.Public) {
+		t.Errorf("PeerPublicKey() = %x; want %x", ctx.PeerPublicKey(), senderKey.Public)
+	}
+}
+
+func TestOpenEnvelopeUnknownVersion(t *testing.T) {
+	var (
+		sender, _    = newContextPair()
+		recipientKey = suite.NewKeypair()
+	)
+
+	envelope, _ := sender.ShutEnvelope([]byte("data"), nil, 1, 0)
+	envelope[len(envelopeMagic)]++
+
+	if _, _, err := OpenEnvelope(&recipientKey, envelope, nil, 1); err != ErrUnknownVersion {
+		t.Errorf("OpenEnvelope(envelope) = %v; want %v", err, ErrUnknownVersion)
+	}
+}
+
+func TestOpenReply(t *testing.T) {
+	var (
+		senderKey    = suite.NewKeypair()
+		recipientKey = suite.NewKeypair()
+		sender       = NewContext(suite, &senderKey, 1)
+
+		data = []byte("data")
+	)
+
+	sender.Init(recipientKey.Public)
+
+	envelope, _ := sender.ShutEnvelope([]byte("request"), nil, 1, 0)
+	recipient, _, err := OpenEnvelope(&recipientKey, envelope, nil, 1)
+
+	if err != nil {
+		t.Fatalf("OpenEnvelope(envelope) = %v; want nil", err)
+	}
+
+	reply, err := recipient.Reply(data, nil, 0)
+
+	if err != nil {
+		t.Fatalf("Reply() = %v; want nil", err)
+	}
+
+	out, err := sender.OpenReply(reply, nil)
+
+	if err != nil {
+		t.Fatalf("OpenReply(reply) = %v; want nil", err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Errorf("OpenReply(reply) = %q; want %q", out, data)
+	}
+}
+
+func TestOpenReplyEphemeral(t *testing.T) {
+	var (
+		senderKey    = suite.NewKeypair()
+		recipientKey = suite.NewKeypair()
+
+		data = []byte("data")
+	)
+
+	for _, expected := range []ciphersuite.PublicKey{nil, suite.NewKeypair().Public, recipientKey.Public} {
+		var (
+			sender    = NewContext(suite, &senderKey, 1)
+			recipient = NewContext(suite, &recipientKey, 1)
+		)
+
+		sender.Init(recipient.EphemeralPublicKey())
+
+		if expected != nil {
+			sender.ExpectPeer(expected)
+		}
+
+		box, _ := sender.Shut([]byte("request"), nil, 1, 0)
+
+		if _, err := recipient.Open(box, nil, 1); err != nil {
+			t.Fatalf("Open(box) = %v; want nil", err)
+		}
+
+		reply, _ := recipient.Reply(data, nil, 0)
+		out, err := sender.OpenReply(reply, nil)
+
+		switch {
+		case bytes.Equal(expected, recipientKey.Public):
+			if err != nil || !bytes.Equal(out, data) {
+				t.Errorf("OpenReply(reply) = %q, %v; want %q, nil", out, err, data)
+			}
+		case err != ErrWrongPeer:
+			t.Errorf("OpenReply(reply, expected = %x) = %v; want %v", expected, err, ErrWrongPeer)
+		}
+	}
+}
+
+func TestReplyForwardSecret(t *testing.T) {
+	var (
+		senderKey    = suite.NewKeypair()
+		recipientKey = suite.NewKeypair()
+		sender       = NewContext(suite, &senderKey, 1)
+	)
+
+	sender.Init(recipientKey.Public)
+
+	envelope, _ := sender.ShutEnvelope([]byte("request"), nil, 1, 0)
+	recipient, _, err := OpenEnvelope(&recipientKey, envelope, nil, 1)
+
+	if err != nil {
+		t.Fatalf("OpenEnvelope(envelope) = %v; want nil", err)
+	}
+
+	reply, err := recipient.Reply([]byte("data"), nil, 0)
+
+	if err != nil {
+		t.Fatalf("Reply() = %v; want nil", err)
+	}
+
+	if bytes.Equal(reply[:len(recipientKey.Public)], recipientKey.Public) {
+		t.Error("Reply() sent the recipient's static key as its ephemeral key")
+	}
+}
+
+func TestKeyringOpen(t *testing.T) {
+	var (
+		senderKey = suite.NewKeypair()
+		keyring   = Keyring{}
+		sender    = NewContext(suite, &senderKey, 1)
+
+		data = []byte("data")
+	)
+
+	for i := 0; i < 3; i++ {
+		key := suite.NewKeypair()
+		keyring = append(keyring, &key)
+	}
+
+	sender.Init(keyring[1].Public)
+
+	box, _ := sender.Shut(data, nil, 1, 0)
+	_, index, out, err := keyring.Open(suite, box, nil, 1)
+
+	if err != nil {
+		t.Fatalf("Keyring.Open(box) = %v; want nil", err)
+	}
+
+	if index != 1 {
+		t.Errorf("Keyring.Open(box) index = %d; want 1", index)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Errorf("Keyring.Open(box) = %q; want %q", out, data)
+	}
+}
+
+func TestMixChainVariable(t *testing.T) {
+	for _, test := range []struct {
+		sender, recipient string
+		opens             bool
+	}{
+		{"offer", "offer", true},
+		{"offer", "other", false},
+	} {
+		sender, recipient := newContextPair()
+
+		sender.MixChainVariable([]byte(test.sender), 16)
+		recipient.MixChainVariable([]byte(test.recipient), 16)
+
+		box, _ := sender.Shut([]byte("data"), nil, 1, 0)
+		_, err := recipient.Open(box, nil, 1)
+
+		if (err == nil) != test.opens {
+			t.Errorf("Open() after mixing %q, %q = %v; want opened = %v", test.sender, test.recipient, err, test.opens)
+		}
+	}
+}
@@ -2,6 +2,20 @@ package box
 
 import "github.com/stouset/go.noise/ciphersuite"
 
+import "bytes"
+import "errors"
+import "io"
+import "time"
+
+var (
+	ErrExpired     = errors.New("noise/box: box has expired")
+	ErrNotYetValid = errors.New("noise/box: box was created in the future")
+	ErrNoRequest   = errors.New("noise/box: no box has been opened to reply to")
+	ErrNoReply     = errors.New("noise/box: no box has been shut to await a reply to")
+	ErrWrongPeer   = errors.New("noise/box: reply is not from the peer addressed")
+	ErrPadding     = errors.New("noise/box: padLen must be less than 2^31")
+)
+
 type Context struct {
 	suite ciphersuite.Ciphersuite
 
@@ -11,6 +25,24 @@ type Context struct {
 	peerKey          *ciphersuite.PublicKey
 
 	cv ciphersuite.ChainVariable
+
+	// where fresh ephemeral keys are drawn from, or nil for the suite's
+	// own source
+	rand io.Reader
+
+	replay ReplayGuard
+
+	lifetime time.Duration
+	now      func() time.Time
+	skew     time.Duration
+	validity *validityPeriod
+
+	// the kdfId of the last box shut or opened, and the key the last
+	// box shut was addressed to, or the one set by ExpectPeer
+	kdfId     int8
+	addressed ciphersuite.PublicKey
+	expected  ciphersuite.PublicKey
+	opened    bool
 }
 
 func NewContext(
@@ -40,9 +72,25 @@ func NewContext(
 		peerKey:          new(ciphersuite.PublicKey),
 		peerEphemeralKey: new(ciphersuite.PublicKey),
 		cv:               suite.NewChain(),
+		now:              time.Now,
 	}
 }
 
+// NewRecipientContext returns a context for opening boxes that were
+// shut to selfKey directly, rather than to an ephemeral key exchanged
+// beforehand.
+func NewRecipientContext(
+	suite ciphersuite.Ciphersuite,
+	selfKey *ciphersuite.Keypair,
+) (
+	ctx *Context,
+) {
+	ctx = NewContext(suite, selfKey, 1)
+	ctx.selfEphemeralKey = selfKey
+
+	return
+}
+
 func (c *Context) EphemeralPublicKey() ciphersuite.PublicKey {
 	return c.selfEphemeralKey.Public
 }
@@ -51,16 +99,131 @@ func (c *Context) PeerPublicKey() ciphersuite.PublicKey {
 	return *c.peerKey
 }
 
+func (c *Context) Suite() ciphersuite.Ciphersuite {
+	return c.suite
+}
+
+// ChainVariable returns a copy of the chain variable, which commits to
+// every box shut or opened by the context so far.
+func (c *Context) ChainVariable() ciphersuite.ChainVariable {
+	return append(ciphersuite.ChainVariable(nil), c.cv...)
+}
+
 func (c *Context) Terminate() {
 	*c = *new(Context)
 }
 
+// SetEntropy makes the context draw its ephemeral keys from rand,
+// replacing the one it was created with. It must be called before any
+// box is shut or opened.
+func (c *Context) SetEntropy(rand io.Reader) error {
+	c.rand = rand
+
+	// a recipient context has no ephemeral key until it replies
+	if c.selfEphemeralKey == c.selfKey {
+		return nil
+	}
+
+	eph, err := c.newKeypair()
+
+	if err != nil {
+		return err
+	}
+
+	c.selfEphemeralKey = &eph
+
+	return nil
+}
+
+func (c *Context) newKeypair() (ciphersuite.Keypair, error) {
+	if c.rand == nil {
+		return c.suite.NewKeypair(), nil
+	}
+
+	return c.suite.NewKeypairFrom(c.rand)
+}
+
+// SetReplayGuard makes Open reject any box whose ephemeral key has
+// already been seen by guard.
+func (c *Context) SetReplayGuard(guard ReplayGuard) {
+	c.replay = guard
+}
+
+// SetLifetime makes Shut embed the current time and an expiry
+// lifetime later into each box. A zero lifetime omits both.
+func (c *Context) SetLifetime(lifetime time.Duration) {
+	c.lifetime = lifetime
+}
+
+// SetClock sets the clock used to timestamp and check boxes, and how
+// far it may disagree with the peer's.
+func (c *Context) SetClock(now func() time.Time, skew time.Duration) {
+	c.now = now
+	c.skew = skew
+}
+
+// Validity returns the creation and expiry times of the last box
+// opened, or zero times if it didn't carry any.
+func (c *Context) Validity() (created time.Time, expires time.Time) {
+	if c.validity == nil {
+		return
+	}
+
+	return c.validity.created, c.validity.expires
+}
+
 func (c *Context) Init(peerEphemeralKey ciphersuite.PublicKey) {
 	*c.peerEphemeralKey = peerEphemeralKey
 }
 
-func (c *Context) Shut(data []byte, kdfId int8, padLen uint32) (box []byte) {
-	return shutBox(
+// ExpectPeer sets the static key that replies to boxes shut afterward
+// must come from. It's needed when the context was initialized with the
+// peer's ephemeral key; otherwise replies must come from the key a box
+// was shut to.
+func (c *Context) ExpectPeer(peerKey ciphersuite.PublicKey) {
+	c.expected = append(ciphersuite.PublicKey(nil), peerKey...)
+}
+
+// MixChainVariable mixes data into the chain variable, so that every box
+// shut or opened afterward depends on it. Both sides must mix the same
+// data at the same point for their boxes to open.
+func (c *Context) MixChainVariable(data []byte, kdfNum int8) {
+	c.cv, _ = c.suite.DeriveCVCC(c.cv, ciphersuite.SymmetricKey(data), kdfNum)
+}
+
+// Shut seals data into a box for the peer. The associated data ad is
+// authenticated but not encrypted or transmitted; the peer must supply
+// the same ad to Open the box. The high bit of padLen is reserved, so
+// it fails with ErrPadding unless padLen is less than 2^31.
+func (c *Context) Shut(
+	data []byte,
+	ad []byte,
+	kdfId int8,
+	padLen uint32,
+) (
+	box []byte,
+	err error,
+) {
+	var validity *validityPeriod
+
+	if padLen&validityFlag != 0 {
+		return nil, ErrPadding
+	}
+
+	if c.lifetime != 0 {
+		now := c.now()
+		validity = &validityPeriod{created: now, expires: now.Add(c.lifetime)}
+	}
+
+	c.kdfId = kdfId
+	c.addressed = c.expected
+	c.opened = false
+
+	if c.addressed == nil {
+		c.addressed = *c.peerEphemeralKey
+	}
+
+	box = shutBox(
 		c.suite,
 		c.selfEphemeralKey,
 		c.selfKey,
@@ -69,19 +232,143 @@ func (c *Context) Shut(data []byte, kdfId int8, padLen uint32) (box []byte) {
 		&c.cv,
 		kdfId*2,
 		padLen,
+		validity,
 		data,
+		ad,
 	)
+
+	return box, nil
 }
 
-func (c *Context) Open(box []byte, kdfId int8) (data []byte, err error) {
-	return openBox(
+// Open authenticates and decrypts a box from the peer. It fails unless
+// ad matches the associated data the box was shut with.
+func (c *Context) Open(
+	box []byte,
+	ad []byte,
+	kdfId int8,
+) (
+	data []byte,
+	err error,
+) {
+	var (
+		validity *validityPeriod
+		now      = c.now()
+
+		// the box is opened against copies of the chain and the peer's
+		// keys, so that a box that's rejected leaves the context as it
+		// was
+		cv               = c.cv
+		peerKey          ciphersuite.PublicKey
+		peerEphemeralKey ciphersuite.PublicKey
+	)
+
+	data, validity, err = openBox(
 		c.suite,
 		c.selfEphemeralKey,
 		c.selfKey,
-		c.peerEphemeralKey,
-		c.peerKey,
-		&c.cv,
+		&peerEphemeralKey,
+		&peerKey,
+		&cv,
 		kdfId*2,
 		box,
+		ad,
 	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if validity != nil {
+		if validity.created.After(now.Add(c.skew)) {
+			return nil, ErrNotYetValid
+		}
+
+		if now.Add(-c.skew).After(validity.expires) {
+			return nil, ErrExpired
+		}
+	}
+
+	// only authenticated boxes are recorded, so that forgeries can't
+	// be used to fill the guard with junk
+	if c.replay != nil {
+		seen, err := c.replay.Seen(peerEphemeralKey, now)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if seen {
+			return nil, ErrReplay
+		}
+	}
+
+	c.cv = cv
+	*c.peerKey = peerKey
+	*c.peerEphemeralKey = peerEphemeralKey
+
+	c.validity = validity
+	c.kdfId = kdfId
+	c.opened = true
+
+	return data, nil
+}
+
+// Reply shuts a response to the box most recently opened. The response
+// continues the chain of that box, so it can only be opened by the
+// context that shut it.
+func (c *Context) Reply(
+	data []byte,
+	ad []byte,
+	padLen uint32,
+) (
+	box []byte,
+	err error,
+) {
+	if !c.opened {
+		return nil, ErrNoRequest
+	}
+
+	// a recipient context would otherwise answer from its static key,
+	// so use a fresh ephemeral key to make the reply forward secret
+	if c.selfEphemeralKey == c.selfKey {
+		eph, err := c.newKeypair()
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.selfEphemeralKey = &eph
+	}
+
+	return c.Shut(data, ad, c.kdfId+1, padLen)
+}
+
+// OpenReply opens the response to the box most recently shut. It fails
+// unless the response came from the holder of the key that box was
+// addressed to, or of the key set by ExpectPeer. A box shut to an
+// ephemeral key can only be replied to once ExpectPeer has been called.
+func (c *Context) OpenReply(
+	box []byte,
+	ad []byte,
+) (
+	data []byte,
+	err error,
+) {
+	if c.opened || c.addressed == nil {
+		return nil, ErrNoReply
+	}
+
+	addressed := c.addressed
+
+	data, err = c.Open(box, ad, c.kdfId+1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(*c.peerKey, addressed) {
+		return nil, ErrWrongPeer
+	}
+
+	return data, nil
 }
@@ -0,0 +1,153 @@
+package box
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "errors"
+
+// An envelope is a box prefixed with a header identifying its format
+// version and ciphersuite, so that it can be opened without knowing
+// either ahead of time:
+//
+//	magic (4) || version (1) || suite name (24) || box
+//
+// The header is authenticated along with the box.
+const (
+	envelopeVersion   = 1
+	envelopeNameLen   = 24
+	envelopeHeaderLen = len(envelopeMagic) + 1 + envelopeNameLen
+)
+
+const envelopeMagic = "NBOX"
+
+var (
+	ErrNotEnvelope    = errors.New("noise/box: not an envelope")
+	ErrUnknownVersion = errors.New("noise/box: unknown envelope version")
+	ErrUnknownSuite   = errors.New("noise/box: unknown envelope ciphersuite")
+	ErrSuiteMismatch  = errors.New("noise/box: envelope ciphersuite doesn't match context")
+)
+
+// ParseEnvelope returns the ciphersuite an envelope was shut with,
+// and the box it holds.
+func ParseEnvelope(
+	envelope []byte,
+) (
+	suite ciphersuite.Ciphersuite,
+	box []byte,
+	err error,
+) {
+	if len(envelope) < envelopeHeaderLen ||
+		string(envelope[:len(envelopeMagic)]) != envelopeMagic {
+		return nil, nil, ErrNotEnvelope
+	}
+
+	if envelope[len(envelopeMagic)] != envelopeVersion {
+		return nil, nil, ErrUnknownVersion
+	}
+
+	name := envelope[len(envelopeMagic)+1 : envelopeHeaderLen]
+
+	for len(name) > 0 && name[len(name)-1] == 0 {
+		name = name[:len(name)-1]
+	}
+
+	if suite = ciphersuite.Lookup(string(name)); suite == nil {
+		return nil, nil, ErrUnknownSuite
+	}
+
+	return suite, envelope[envelopeHeaderLen:], nil
+}
+
+// OpenEnvelope opens an envelope that was shut to selfKey, using
+// whichever ciphersuite the envelope names. The returned context holds
+// the state of the opened box, such as the sender's public key.
+func OpenEnvelope(
+	selfKey *ciphersuite.Keypair,
+	envelope []byte,
+	ad []byte,
+	kdfId int8,
+) (
+	ctx *Context,
+	data []byte,
+	err error,
+) {
+	suite, _, err := ParseEnvelope(envelope)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx = NewRecipientContext(suite, selfKey)
+	data, err = ctx.OpenEnvelope(envelope, ad, kdfId)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ctx, data, nil
+}
+
+// ShutEnvelope is like Shut, but wraps the box in an envelope.
+func (c *Context) ShutEnvelope(
+	data []byte,
+	ad []byte,
+	kdfId int8,
+	padLen uint32,
+) (
+	envelope []byte,
+	err error,
+) {
+	header := envelopeHeader(c.suite)
+	box, err := c.Shut(data, append(header, ad...), kdfId, padLen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, box...), nil
+}
+
+// OpenEnvelope is like Open, but unwraps the box from an envelope. It
+// fails if the envelope was shut with a different ciphersuite than the
+// context's.
+func (c *Context) OpenEnvelope(
+	envelope []byte,
+	ad []byte,
+	kdfId int8,
+) (
+	data []byte,
+	err error,
+) {
+	suite, box, err := ParseEnvelope(envelope)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if suite != c.suite {
+		return nil, ErrSuiteMismatch
+	}
+
+	header := envelopeHeader(c.suite)
+
+	return c.Open(box, append(header, ad...), kdfId)
+}
+
+func envelopeHeader(
+	suite ciphersuite.Ciphersuite,
+) (
+	header []byte,
+) {
+	name := suite.Name()
+
+	if len(name) > envelopeNameLen {
+		panic("noise/box: ciphersuite name is too long for an envelope")
+	}
+
+	header = make([]byte, envelopeHeaderLen)
+
+	copy(header[0:], envelopeMagic)
+	header[len(envelopeMagic)] = envelopeVersion
+	copy(header[len(envelopeMagic)+1:], name)
+
+	return
+}
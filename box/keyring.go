@@ -0,0 +1,105 @@
+package box
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "crypto/subtle"
+import "errors"
+
+var ErrNoMatchingKey = errors.New("noise/box: box wasn't shut to any key in the keyring")
+
+// A Keyring holds several local identities, any of which a box may
+// have been shut to.
+type Keyring []*ciphersuite.Keypair
+
+// Open opens a box that was shut to one of the keys in the keyring,
+// and returns the index of that key. Every key is tried, whether or
+// not an earlier one matched, so the time taken doesn't reveal which
+// one did.
+//
+// It does reveal whether any key matched: a trial whose header
+// authenticates goes on to decrypt it, and only a match goes on to
+// open the body. Each trial is therefore not constant time on its own,
+// and an observer able to time them individually, rather than the
+// call as a whole, could tell where the match was.
+func (k Keyring) Open(
+	suite ciphersuite.Ciphersuite,
+	box []byte,
+	ad []byte,
+	kdfId int8,
+) (
+	ctx *Context,
+	index int,
+	data []byte,
+	err error,
+) {
+	if index = k.match(suite, box, kdfId); index < 0 {
+		return nil, -1, nil, ErrNoMatchingKey
+	}
+
+	ctx = NewRecipientContext(suite, k[index])
+
+	if data, err = ctx.Open(box, ad, kdfId); err != nil {
+		return nil, -1, nil, err
+	}
+
+	return ctx, index, data, nil
+}
+
+// OpenEnvelope is like Open, but unwraps the box from an envelope and
+// uses whichever ciphersuite it names.
+func (k Keyring) OpenEnvelope(
+	envelope []byte,
+	ad []byte,
+	kdfId int8,
+) (
+	ctx *Context,
+	index int,
+	data []byte,
+	err error,
+) {
+	suite, box, err := ParseEnvelope(envelope)
+
+	if err != nil {
+		return nil, -1, nil, err
+	}
+
+	if index = k.match(suite, box, kdfId); index < 0 {
+		return nil, -1, nil, ErrNoMatchingKey
+	}
+
+	ctx = NewRecipientContext(suite, k[index])
+
+	if data, err = ctx.OpenEnvelope(envelope, ad, kdfId); err != nil {
+		return nil, -1, nil, err
+	}
+
+	return ctx, index, data, nil
+}
+
+// Trials every key against the box's header, selecting the first
+// that matches without branching on its index, so that the work done
+// depends only on the number of keys and on whether one matched.
+func (k Keyring) match(
+	suite ciphersuite.Ciphersuite,
+	box []byte,
+	kdfId int8,
+) (
+	index int,
+) {
+	var found int
+
+	index = -1
+
+	for i, key := range k {
+		var ok int
+
+		if matchBoxHeader(suite, key, kdfId*2, box) {
+			ok = 1
+		}
+
+		index = subtle.ConstantTimeSelect(ok&^found, i, index)
+		found |= ok
+	}
+
+	return
+}
@@ -0,0 +1,264 @@
+package box
+
+import "bufio"
+import "container/list"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+var ErrReplay = errors.New("noise/box: box has already been opened")
+
+// A ReplayGuard remembers the ephemeral keys of boxes that have been
+// opened. Seen records id as having been seen at now, and reports
+// whether it had already been recorded.
+type ReplayGuard interface {
+	Seen(id []byte, now time.Time) (seen bool, err error)
+}
+
+// MemoryReplayCache is a ReplayGuard that holds up to size ids in
+// memory, evicting the oldest first. Ids older than window are
+// forgotten; a zero window keeps them until they are evicted.
+type MemoryReplayCache struct {
+	mu sync.Mutex
+
+	size   int
+	window time.Duration
+
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type replayEntry struct {
+	id   string
+	seen time.Time
+}
+
+func NewMemoryReplayCache(
+	size int,
+	window time.Duration,
+) (
+	cache *MemoryReplayCache,
+) {
+	return &MemoryReplayCache{
+		size:    size,
+		window:  window,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *MemoryReplayCache) Seen(
+	id []byte,
+	now time.Time,
+) (
+	seen bool,
+	err error,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.seen(string(id), now), nil
+}
+
+func (c *MemoryReplayCache) seen(id string, now time.Time) bool {
+	c.expire(now)
+
+	if _, ok := c.entries[id]; ok {
+		return true
+	}
+
+	c.entries[id] = c.order.PushBack(&replayEntry{id: id, seen: now})
+
+	for c.size > 0 && c.order.Len() > c.size {
+		c.remove(c.order.Front())
+	}
+
+	return false
+}
+
+func (c *MemoryReplayCache) expire(now time.Time) {
+	if c.window <= 0 {
+		return
+	}
+
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		if now.Sub(e.Value.(*replayEntry).seen) < c.window {
+			return
+		}
+
+		c.remove(e)
+	}
+}
+
+func (c *MemoryReplayCache) remove(e *list.Element) {
+	delete(c.entries, e.Value.(*replayEntry).id)
+	c.order.Remove(e)
+}
+
+// FileReplayCache is a MemoryReplayCache that persists its ids to a
+// file, so that boxes can't be replayed across restarts. Each line of
+// the file holds a hex-encoded id and the time it was seen in Unix
+// nanoseconds.
+type FileReplayCache struct {
+	*MemoryReplayCache
+
+	path  string
+	file  *os.File
+	lines int
+}
+
+func NewFileReplayCache(
+	path string,
+	size int,
+	window time.Duration,
+) (
+	cache *FileReplayCache,
+	err error,
+) {
+	cache = &FileReplayCache{
+		MemoryReplayCache: NewMemoryReplayCache(size, window),
+		path:              path,
+	}
+
+	if err = cache.load(); err != nil {
+		return nil, err
+	}
+
+	if err = cache.compact(); err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+func (c *FileReplayCache) Seen(
+	id []byte,
+	now time.Time,
+) (
+	seen bool,
+	err error,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen(string(id), now) {
+		return true, nil
+	}
+
+	// the file is only ever appended to, so rewrite it once at least
+	// half its lines are for ids that have since been evicted or have
+	// expired
+	if c.lines > 0 && c.lines >= 2*(c.order.Len()-1) {
+		return false, c.compact()
+	}
+
+	if _, err = c.file.WriteString(replayLine(string(id), now)); err != nil {
+		return false, err
+	}
+
+	c.lines++
+
+	return false, c.file.Sync()
+}
+
+func (c *FileReplayCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.file.Close()
+}
+
+func (c *FileReplayCache) load() error {
+	file, err := os.Open(c.path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) != 2 {
+			return fmt.Errorf("noise/box: %s:%d: malformed replay entry", c.path, n)
+		}
+
+		id, err := hex.DecodeString(fields[0])
+
+		if err != nil {
+			return fmt.Errorf("noise/box: %s:%d: %s", c.path, n, err)
+		}
+
+		nsec, err := strconv.ParseInt(fields[1], 10, 64)
+
+		if err != nil {
+			return fmt.Errorf("noise/box: %s:%d: %s", c.path, n, err)
+		}
+
+		c.seen(string(id), time.Unix(0, nsec))
+	}
+
+	// entries only expire relative to each other as they're loaded;
+	// the ones that have aged out since they were written are dropped
+	// by the first Seen, whose clock is the caller's
+	return scanner.Err()
+}
+
+// Rewrites the file with only the live entries, replacing it
+// atomically so that a crash can't lose the ones already recorded.
+func (c *FileReplayCache) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".replay")
+
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*replayEntry)
+		w.WriteString(replayLine(entry.id, entry.seen))
+	}
+
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+
+		return err
+	}
+
+	if c.file != nil {
+		c.file.Close()
+	}
+
+	c.file = tmp
+	c.lines = c.order.Len()
+
+	return nil
+}
+
+func replayLine(id string, seen time.Time) string {
+	return hex.EncodeToString([]byte(id)) + " " +
+		strconv.FormatInt(seen.UnixNano(), 10) + "\n"
+}
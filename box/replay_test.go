@@ -0,0 +1,133 @@
+package box
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryReplayCacheSeen(t *testing.T) {
+	var (
+		cache = NewMemoryReplayCache(2, 0)
+		now   = time.Unix(0, 0)
+	)
+
+	for _, test := range []struct {
+		id   string
+		seen bool
+	}{
+		{"a", false},
+		{"a", true},
+		{"b", false},
+		{"c", false},
+		{"a", false}, // evicted by "c"
+		{"c", true},
+	} {
+		seen, _ := cache.Seen([]byte(test.id), now)
+
+		if seen != test.seen {
+			t.Errorf("Seen(%q) = %v; want %v", test.id, seen, test.seen)
+		}
+	}
+}
+
+func TestMemoryReplayCacheWindow(t *testing.T) {
+	var (
+		cache = NewMemoryReplayCache(0, time.Minute)
+		now   = time.Unix(0, 0)
+	)
+
+	cache.Seen([]byte("a"), now)
+
+	if seen, _ := cache.Seen([]byte("a"), now.Add(time.Second)); !seen {
+		t.Error("Seen(\"a\") within window = false; want true")
+	}
+
+	if seen, _ := cache.Seen([]byte("a"), now.Add(time.Hour)); seen {
+		t.Error("Seen(\"a\") after window = true; want false")
+	}
+}
+
+func TestFileReplayCachePersists(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "replay")
+		now  = time.Now()
+	)
+
+	cache, err := NewFileReplayCache(path, 16, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Seen([]byte("a"), now)
+	cache.Close()
+
+	cache, err = NewFileReplayCache(path, 16, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cache.Close()
+
+	if seen, _ := cache.Seen([]byte("a"), now); !seen {
+		t.Error("Seen(\"a\") after reload = false; want true")
+	}
+}
+
+func TestFileReplayCacheExpiresOnLoad(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "replay")
+		then = time.Unix(0, 0)
+		now  = then.Add(2 * time.Hour)
+	)
+
+	os.WriteFile(path, []byte(replayLine("a", then)), 0600)
+
+	cache, err := NewFileReplayCache(path, 16, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cache.Close()
+
+	if seen, _ := cache.Seen([]byte("b"), now); seen {
+		t.Error("Seen(\"b\") = true; want false")
+	}
+
+	if n := cache.order.Len(); n != 1 {
+		t.Errorf("Seen() kept %d entries; want 1", n)
+	}
+
+	if contents, _ := os.ReadFile(path); string(contents) != replayLine("b", now) {
+		t.Errorf("file = %q; want only the live entry", contents)
+	}
+}
+
+func TestFileReplayCacheCompactsExpired(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "replay")
+		now  = time.Unix(0, 0)
+	)
+
+	// with no size limit, only expiry keeps the file from growing
+	cache, err := NewFileReplayCache(path, 0, time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cache.Close()
+
+	for i := 0; i < 1000; i++ {
+		cache.Seen([]byte(strconv.Itoa(i)), now.Add(time.Duration(i)*time.Second))
+	}
+
+	if live := cache.order.Len(); cache.lines > 2*live {
+		t.Errorf("file holds %d lines for %d live entries; want at most %d", cache.lines, live, 2*live)
+	}
+}
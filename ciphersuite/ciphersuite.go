@@ -9,6 +9,9 @@ package ciphersuite
 // #include <sodium/core.h>
 import "C"
 
+import "io"
+import "strings"
+
 type (
 	// TODO: ensure SymmetricKeys and PrivateKeys are always mlock'd
 	SymmetricKey []byte
@@ -28,9 +31,15 @@ type Keypair struct {
 }
 
 type Ciphersuite interface {
+	Name() string
+
 	NewKeypair() Keypair
 	NewChain() ChainVariable
 
+	// NewKeypairFrom is like NewKeypair, but draws the key's randomness
+	// from rand.
+	NewKeypairFrom(rand io.Reader) (Keypair, error)
+
 	// TODO: are these still necessary?
 	DHLen() int
 	MACLen() int
@@ -61,6 +70,15 @@ type Ciphersuite interface {
 	DeriveCCCC(
 		cv ChainVariable,
 	) (client CipherContext, server CipherContext)
+
+	// DeriveKey derives outLen bytes of keying material from cv,
+	// distinct for each info and from the cipher contexts derived from
+	// the same cv. It panics if outLen exceeds MaxDeriveKeyLen.
+	DeriveKey(
+		cv ChainVariable,
+		info []byte,
+		outLen int,
+	) []byte
 }
 
 type ciphersuite struct {
@@ -71,6 +89,22 @@ type ciphersuite struct {
 	cvLen  int
 }
 
+var suites = make(map[string]Ciphersuite)
+
+func register(suite Ciphersuite) {
+	suites[suite.Name()] = suite
+}
+
+// Lookup returns the ciphersuite with the given name, or nil if there
+// is no such ciphersuite.
+func Lookup(name string) Ciphersuite {
+	return suites[name]
+}
+
+func (c *ciphersuite) Name() string {
+	return strings.TrimRight(string(c.name[:]), "\x00")
+}
+
 func (c *ciphersuite) NewChain() ChainVariable {
 	return make([]byte, c.cvLen)
 }
@@ -116,6 +150,20 @@ func (c *ciphersuite) DeriveCCCC(
 	return pair[:c.ccLen], pair[c.ccLen:]
 }
 
+func (c *ciphersuite) DeriveKey(
+	cv ChainVariable,
+	info []byte,
+	outLen int,
+) []byte {
+	var (
+		secret = cv
+		extra  = make([]byte, c.cvLen)
+		label  = append(append(c.name[:], byte(7)), info...)
+	)
+
+	return kdf(secret, extra, label, outLen)[:outLen]
+}
+
 func init() {
 	if int(C.sodium_init()) != 0 {
 		panic("noise/ciphersuite: libsodium couldn't be initialized")
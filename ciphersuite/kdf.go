@@ -4,6 +4,10 @@ package ciphersuite
 // #include <sodium/crypto_auth_hmacsha512.h>
 import "C"
 
+// The most output the kdf can derive, since its block counter is a
+// single byte.
+const MaxDeriveKeyLen = 255 * 64
+
 // Derives a key from a secret, a chaining variable (as extra), and an
 // info parameter used to ensure uniqueness of the inputs as a whole.
 func kdf(
@@ -14,6 +18,10 @@ func kdf(
 ) []byte {
 	const hashLen = 64
 
+	if outLen < 0 || outLen > MaxDeriveKeyLen {
+		panic("noise/ciphersuite: kdf output length out of range")
+	}
+
 	var (
 		// the number of blocks we need to generate, plus a
 		// counter to track our progress through them
@@ -21,7 +29,7 @@ func kdf(
 		c      = byte(0)
 
 		// preallocate memory for the entire output
-		out = make([]byte, blocks*hashLen)
+		out = make([]byte, int(blocks)*hashLen)
 
 		// offsets for the different fields that comprise the
 		// message that gets hashed
@@ -68,3 +68,19 @@ func TestKdfTestVectors(t *testing.T) {
 		}
 	}
 }
+
+func TestKdfLongOutput(t *testing.T) {
+	long := kdf([]byte("secret"), []byte("extra"), []byte("info"), MaxDeriveKeyLen)
+
+	if len(long) != MaxDeriveKeyLen {
+		t.Fatalf("len(kdf(%d)) = %d; want %d", MaxDeriveKeyLen, len(long), MaxDeriveKeyLen)
+	}
+
+	for _, outLen := range []int{128, 192, 193, 256, 1000} {
+		out := kdf([]byte("secret"), []byte("extra"), []byte("info"), outLen)
+
+		if !bytes.Equal(out, long[:outLen]) {
+			t.Errorf("kdf(%d) isn't a prefix of kdf(%d)", outLen, MaxDeriveKeyLen)
+		}
+	}
+}
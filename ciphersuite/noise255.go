@@ -1,5 +1,7 @@
 package ciphersuite
 
+import "io"
+
 var Noise255 = &noise255{
 	ciphersuite{
 		name:   [24]byte{'N', 'o', 'i', 's', 'e', '2', '5', '5'},
@@ -12,6 +14,10 @@ var Noise255 = &noise255{
 
 type noise255 struct{ ciphersuite }
 
+func init() {
+	register(Noise255)
+}
+
 func (n *noise255) NewKeypair() Keypair {
 	var keypair = Keypair{
 		Private: make([]byte, curve25519_privKeyLen),
@@ -23,6 +29,28 @@ func (n *noise255) NewKeypair() Keypair {
 	return keypair
 }
 
+func (n *noise255) NewKeypairFrom(rand io.Reader) (Keypair, error) {
+	var (
+		random  = make([]byte, curve25519_privKeyLen)
+		keypair = Keypair{
+			Private: make([]byte, curve25519_privKeyLen),
+			Public:  make([]byte, curve25519_pubKeyLen),
+		}
+	)
+
+	if _, err := io.ReadFull(rand, random); err != nil {
+		return Keypair{}, err
+	}
+
+	noise_curve25519_keypair_from(random, keypair.Private, keypair.Public)
+
+	for i := range random {
+		random[i] = 0
+	}
+
+	return keypair, nil
+}
+
 func (n *noise255) DH(privKey PrivateKey, pubKey PublicKey) SymmetricKey {
 	dh := make([]byte, n.dhLen)
 
@@ -83,7 +83,7 @@ func TestDH(t *testing.T) {
 	var (
 		private  = []byte("\xc0\x94\x79\x59\xc2\xfd\x54\x27\xa2\xf3\x9b\xd8\x80\x41\x1d\xfc\x96\xb8\x36\x11\x3d\xbc\x0f\xec\x61\xee\x17\x07\x67\xe3\x7f\x5a")
 		public   = []byte("\x1d\x76\x54\xef\xd5\xc2\x01\x23\xa2\x3b\x14\x49\x23\x32\xb4\x87\x58\x68\xcb\x1d\x87\x5c\xd9\x5e\x0c\x35\x1a\xa2\x0f\xb6\x3d\x7c")
-		expected = []byte("\x12\xa4\xe0\x6c\x7b\xf4\x45\x39\x53\xa1\xe1\x85\x5c\xe3\x4d\x5d\x33\x0f\x92\xb7\xf7\x19\x63\xaa\xf1\xcb\x59\x5c\x64\x69\xf9\x61")
+		expected = []byte("\xc8\x2a\x95\xc3\xf5\x97\xa0\xb3\x66\xa6\xbe\x14\x27\x32\xdb\xd8\x14\xe7\x03\x5b\xdc\x4e\xb7\x47\x24\xbb\xbf\xf8\xbb\xb6\xb2\x6f")
 	)
 
 	dh := Noise255.DH(private, public)
@@ -98,3 +98,85 @@ func TestDH(t *testing.T) {
 		)
 	}
 }
+
+func TestKeypairPublicIsBasepointMultiple(t *testing.T) {
+	var (
+		basepoint = append([]byte{9}, make([]byte, 31)...)
+		random    = bytes.Repeat([]byte{1}, curve25519_privKeyLen)
+	)
+
+	from, _ := Noise255.NewKeypairFrom(bytes.NewReader(random))
+
+	for _, pair := range []Keypair{Noise255.NewKeypair(), from} {
+		if public := Noise255.DH(pair.Private, basepoint); !bytes.Equal(public, pair.Public) {
+			t.Errorf("DH(Private, 9) = %x; want Public = %x", public, pair.Public)
+		}
+	}
+}
+
+func TestLookupNoise255(t *testing.T) {
+	if suite := Lookup(Noise255.Name()); suite != Noise255 {
+		t.Errorf("Lookup(%q) = %v; want Noise255", Noise255.Name(), suite)
+	}
+}
+
+func TestNewKeypairFrom(t *testing.T) {
+	var (
+		random = bytes.Repeat([]byte{1}, curve25519_privKeyLen)
+		peer   = Noise255.NewKeypair()
+	)
+
+	pair1, err := Noise255.NewKeypairFrom(bytes.NewReader(random))
+
+	if err != nil {
+		t.Fatalf("NewKeypairFrom() = %v; want nil", err)
+	}
+
+	pair2, _ := Noise255.NewKeypairFrom(bytes.NewReader(random))
+
+	if !reflect.DeepEqual(pair1, pair2) {
+		t.Error("NewKeypairFrom(random) isn't deterministic")
+	}
+
+	var (
+		dh1 = Noise255.DH(pair1.Private, peer.Public)
+		dh2 = Noise255.DH(peer.Private, pair1.Public)
+	)
+
+	if !bytes.Equal(dh1, dh2) {
+		t.Errorf("DH() = %x, %x; want equal", dh1, dh2)
+	}
+}
+
+func TestNewKeypairFromShortRead(t *testing.T) {
+	if _, err := Noise255.NewKeypairFrom(bytes.NewReader(nil)); err == nil {
+		t.Error("NewKeypairFrom(empty) = nil; want error")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	var (
+		cv = Noise255.NewChain()
+
+		key1 = Noise255.DeriveKey(cv, []byte("one"), 100)
+		key2 = Noise255.DeriveKey(cv, []byte("two"), 100)
+
+		client, server = Noise255.DeriveCCCC(cv)
+	)
+
+	if len(key1) != 100 {
+		t.Errorf("len(DeriveKey(cv, \"one\", 100)) = %d; want 100", len(key1))
+	}
+
+	if bytes.Equal(key1, key2) {
+		t.Error("DeriveKey(cv, info) isn't distinct for each info")
+	}
+
+	if bytes.Equal(key1[:len(client)], client) || bytes.Equal(key1[:len(server)], server) {
+		t.Error("DeriveKey(cv, info) matches DeriveCCCC(cv)")
+	}
+
+	if short := Noise255.DeriveKey(cv, []byte("one"), 10); !bytes.Equal(short, key1[:10]) {
+		t.Errorf("DeriveKey(cv, \"one\", 10) = %x; want %x", short, key1[:10])
+	}
+}
@@ -6,8 +6,8 @@ package ciphersuite
 import "C"
 
 var (
-	curve25519_privKeyLen = int(C.crypto_scalarmult_curve25519_bytes())
-	curve25519_pubKeyLen  = int(C.crypto_scalarmult_curve25519_scalarbytes())
+	curve25519_privKeyLen = int(C.crypto_scalarmult_curve25519_scalarbytes())
+	curve25519_pubKeyLen  = int(C.crypto_scalarmult_curve25519_bytes())
 	curve25519_dhLen      = int(C.crypto_scalarmult_curve25519_bytes())
 )
 
@@ -16,8 +16,8 @@ func noise_curve25519_keypair(
 	publicKey []byte,
 ) {
 	var (
-		pubPtr  = byteArrayPtr(privateKey)
-		privPtr = byteArrayPtr(publicKey)
+		privPtr = byteArrayPtr(privateKey)
+		pubPtr  = byteArrayPtr(publicKey)
 		privLen = C.ulonglong(curve25519_privKeyLen)
 	)
 
@@ -25,6 +25,22 @@ func noise_curve25519_keypair(
 	C.crypto_scalarmult_curve25519_base(pubPtr, privPtr)
 }
 
+// Like noise_curve25519_keypair, but with randomness supplied by the
+// caller rather than libsodium.
+func noise_curve25519_keypair_from(
+	random []byte,
+	privateKey []byte,
+	publicKey []byte,
+) {
+	var (
+		privPtr = byteArrayPtr(privateKey)
+		pubPtr  = byteArrayPtr(publicKey)
+	)
+
+	copy(privateKey, random)
+	C.crypto_scalarmult_curve25519_base(pubPtr, privPtr)
+}
+
 func noise_curve25519_dh(
 	dhKey []byte,
 	privateKey []byte,
@@ -36,7 +52,7 @@ func noise_curve25519_dh(
 		pubPtr  = byteArrayPtr(publicKey)
 	)
 
-	C.crypto_scalarmult_curve25519(dhPtr, pubPtr, privPtr)
+	C.crypto_scalarmult_curve25519(dhPtr, privPtr, pubPtr)
 }
 
 // Ensure that probed lengths match ones that are hardcoded in the
@@ -17,13 +17,22 @@ func main() {
 	defer clientHandshake.Terminate()
 	defer serverHandshake.Terminate()
 
-	clientEphemeralKey := clientHandshake.Eph()
-	serverHandshake.Eph(clientEphemeralKey)
-
-	var syn1, syn2, ack1, ack2 []byte
+	var eph, syn1, syn2, ack1, ack2 []byte
 	var err error
 
-	syn1 = serverHandshake.Syn([]byte("hoy!"), 0)
+	eph, err = clientHandshake.Eph()
+
+	if err != nil {
+		goto err
+	}
+
+	err = serverHandshake.Eph(eph)
+
+	if err != nil {
+		goto err
+	}
+
+	syn1, err = serverHandshake.Syn([]byte("hoy!"), 0)
 
 	if err != nil {
 		goto err
@@ -38,7 +47,7 @@ func main() {
 	fmt.Printf("Syn: %x\n", syn1)
 	fmt.Printf("Syn Contents: %s\n", syn2)
 
-	ack1 = clientHandshake.Ack([]byte("hoy hoy!"), 0)
+	ack1, err = clientHandshake.Ack([]byte("hoy hoy!"), 0)
 
 	if err != nil {
 		goto err
@@ -0,0 +1,256 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "bufio"
+import "bytes"
+import "crypto/sha256"
+import "errors"
+import "fmt"
+import "os"
+import "strings"
+import "sync"
+import "time"
+
+var (
+	ErrUnauthorized         = errors.New("noise/pipe: client key is not authorized")
+	ErrAuthorizationExpired = errors.New("noise/pipe: client key authorization has expired")
+)
+
+// An AuthorizedKey is an entry in an authorized keys file.
+type AuthorizedKey struct {
+	Fingerprint string
+	Options     map[string]string
+	Comment     string
+
+	// Expires is parsed from the "expires" option, and is zero if the
+	// entry never expires.
+	Expires time.Time
+
+	// Command is the "command" option, or empty if there is none. The
+	// pipe package doesn't run commands, so a server that honors this
+	// option must enforce it itself, using the entry from
+	// Session.AuthorizedKey.
+	Command string
+}
+
+// AuthorizedKeys is a set of client keys a server accepts, kept in a
+// text file that is reloaded whenever it changes. Each line holds a
+// key fingerprint, followed by any number of name=value options, and
+// optionally a comment beginning with '#':
+//
+//	SHA256:... command="backup --verbose" expires=2027-01-01 # alice
+//
+// Option values containing whitespace must be double-quoted. Blank
+// lines and lines beginning with '#' are ignored. Only "expires" is
+// enforced when authorizing a key; the other options are left to the
+// caller. If the file can't be reloaded, the keys last read from it
+// are still used, and the error is reported by Err.
+type AuthorizedKeys struct {
+	mu sync.Mutex
+
+	path string
+	sum  [sha256.Size]byte
+	keys map[string]*AuthorizedKey
+	err  error
+
+	// the file's size and modification time when it was last read, and
+	// when that was
+	size  int64
+	mtime time.Time
+	read  time.Time
+
+	now func() time.Time
+}
+
+// LoadAuthorizedKeys reads an authorized keys file.
+func LoadAuthorizedKeys(
+	path string,
+) (
+	a *AuthorizedKeys,
+	err error,
+) {
+	a = &AuthorizedKeys{path: path, now: time.Now}
+
+	if err = a.reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Authorize returns the entry for key, or an error if the key isn't
+// authorized or its entry has expired.
+func (a *AuthorizedKeys) Authorize(key ciphersuite.PublicKey) (*AuthorizedKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.err = a.reload()
+
+	entry, ok := a.keys[Fingerprint(key)]
+
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+
+	if !entry.Expires.IsZero() && a.now().After(entry.Expires) {
+		return nil, ErrAuthorizationExpired
+	}
+
+	return entry, nil
+}
+
+// Err returns the error from the last attempt to reload the file, or
+// nil if it succeeded.
+func (a *AuthorizedKeys) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.err
+}
+
+// Verifier returns a PeerVerifier that rejects clients whose keys
+// aren't authorized.
+func (a *AuthorizedKeys) Verifier() PeerVerifier {
+	return func(key ciphersuite.PublicKey) error {
+		_, err := a.Authorize(key)
+		return err
+	}
+}
+
+// Reparses the file if its contents have changed since it was last
+// read. It's only reread if its size or modification time have changed,
+// or if it was last read so soon after being modified that an edit made
+// since might not have changed them, and is then only reparsed if its
+// hash has changed.
+func (a *AuthorizedKeys) reload() error {
+	info, err := os.Stat(a.path)
+
+	if err != nil {
+		return err
+	}
+
+	if a.keys != nil && info.Size() == a.size && info.ModTime().Equal(a.mtime) && a.read.Sub(a.mtime) > time.Second {
+		return nil
+	}
+
+	read := time.Now()
+	contents, err := os.ReadFile(a.path)
+
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(contents)
+
+	if a.keys != nil && sum == a.sum {
+		a.size, a.mtime, a.read = info.Size(), info.ModTime(), read
+		return nil
+	}
+
+	var (
+		keys    = make(map[string]*AuthorizedKey)
+		scanner = bufio.NewScanner(bytes.NewReader(contents))
+	)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		entry, err := parseAuthorizedKey(line)
+
+		if err != nil {
+			return fmt.Errorf("noise/pipe: %s:%d: %s", a.path, n, err)
+		}
+
+		keys[entry.Fingerprint] = entry
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	a.keys = keys
+	a.sum = sum
+	a.size, a.mtime, a.read = info.Size(), info.ModTime(), read
+
+	return nil
+}
+
+func parseAuthorizedKey(line string) (entry *AuthorizedKey, err error) {
+	entry = &AuthorizedKey{Options: make(map[string]string)}
+
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		entry.Fingerprint, line = line[:i], strings.TrimLeft(line[i:], " \t")
+	} else {
+		entry.Fingerprint, line = line, ""
+	}
+
+	for line != "" {
+		if line[0] == '#' {
+			entry.Comment = strings.TrimSpace(line[1:])
+			break
+		}
+
+		var name, value string
+
+		if name, value, line, err = parseOption(line); err != nil {
+			return nil, err
+		}
+
+		entry.Options[name] = value
+		line = strings.TrimLeft(line, " \t")
+	}
+
+	entry.Command = entry.Options["command"]
+
+	if expires, ok := entry.Options["expires"]; ok {
+		if entry.Expires, err = parseExpiry(expires); err != nil {
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// Splits a name=value or name="value" option from the front of line.
+func parseOption(line string) (name string, value string, rest string, err error) {
+	eq := strings.IndexByte(line, '=')
+
+	if eq <= 0 || strings.ContainsAny(line[:eq], " \t") {
+		return "", "", "", errors.New("malformed option")
+	}
+
+	name, line = line[:eq], line[eq+1:]
+
+	if strings.HasPrefix(line, `"`) {
+		end := strings.IndexByte(line[1:], '"')
+
+		if end < 0 {
+			return "", "", "", fmt.Errorf("unterminated value for option %q", name)
+		}
+
+		return name, line[1 : end+1], line[end+2:], nil
+	}
+
+	if end := strings.IndexAny(line, " \t"); end >= 0 {
+		return name, line[:end], line[end:], nil
+	}
+
+	return name, line, "", nil
+}
+
+func parseExpiry(value string) (expires time.Time, err error) {
+	if expires, err = time.Parse(time.RFC3339, value); err == nil {
+		return expires, nil
+	}
+
+	if expires, err = time.Parse("2006-01-02", value); err == nil {
+		return expires, nil
+	}
+
+	return time.Time{}, fmt.Errorf("malformed expiry %q", value)
+}
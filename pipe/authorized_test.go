@@ -0,0 +1,160 @@
+package pipe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthorizedKeysOptions(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "authorized_keys")
+		key  = suite.NewKeypair().Public
+		line = Fingerprint(key) + ` command="backup --verbose" expires=2027-01-01 # alice` + "\n"
+	)
+
+	os.WriteFile(path, []byte(line), 0600)
+
+	keys, err := LoadAuthorizedKeys(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.now = func() time.Time { return time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	entry, err := keys.Authorize(key)
+
+	if err != nil {
+		t.Fatalf("Authorize(key) = %v; want nil", err)
+	}
+
+	if entry.Command != "backup --verbose" || entry.Comment != "alice" {
+		t.Errorf("Authorize(key) = %+v; want command \"backup --verbose\" and comment \"alice\"", entry)
+	}
+
+	if _, err = keys.Authorize(suite.NewKeypair().Public); err != ErrUnauthorized {
+		t.Errorf("Authorize(other) = %v; want %v", err, ErrUnauthorized)
+	}
+
+	keys.now = func() time.Time { return time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	if _, err = keys.Authorize(key); err != ErrAuthorizationExpired {
+		t.Errorf("Authorize(expired) = %v; want %v", err, ErrAuthorizationExpired)
+	}
+}
+
+func TestAuthorizedKeysReload(t *testing.T) {
+	var (
+		path  = filepath.Join(t.TempDir(), "authorized_keys")
+		key   = suite.NewKeypair().Public
+		other = suite.NewKeypair().Public
+		now   = time.Now()
+	)
+
+	os.WriteFile(path, []byte(Fingerprint(other)+"\n"), 0600)
+	os.Chtimes(path, now, now)
+
+	keys, err := LoadAuthorizedKeys(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an edit of the same size, within the same second
+	os.WriteFile(path, []byte(Fingerprint(key)+"\n"), 0600)
+	os.Chtimes(path, now, now)
+
+	if _, err = keys.Authorize(key); err != nil {
+		t.Errorf("Authorize(key) after reload = %v; want nil", err)
+	}
+}
+
+func TestAuthorizedKeysReloadUnchanged(t *testing.T) {
+	var (
+		path  = filepath.Join(t.TempDir(), "authorized_keys")
+		key   = suite.NewKeypair().Public
+		other = suite.NewKeypair().Public
+		then  = time.Now().Add(-time.Hour)
+	)
+
+	os.WriteFile(path, []byte(Fingerprint(key)+"\n"), 0600)
+	os.Chtimes(path, then, then)
+
+	keys, err := LoadAuthorizedKeys(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file's size and modification time are unchanged and long
+	// settled, so it isn't reread
+	os.WriteFile(path, []byte(Fingerprint(other)+"\n"), 0600)
+	os.Chtimes(path, then, then)
+
+	if _, err = keys.Authorize(key); err != nil {
+		t.Errorf("Authorize(key) with unchanged mtime = %v; want nil", err)
+	}
+}
+
+func TestAuthorizedKeysReloadError(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "authorized_keys")
+		key  = suite.NewKeypair().Public
+	)
+
+	os.WriteFile(path, []byte(Fingerprint(key)+"\n"), 0600)
+
+	keys, err := LoadAuthorizedKeys(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(path, []byte(Fingerprint(key)+" expires=never\n"), 0600)
+
+	if _, err = keys.Authorize(key); err != nil {
+		t.Errorf("Authorize(key) after a bad edit = %v; want nil", err)
+	}
+
+	if keys.Err() == nil {
+		t.Error("Err() after a bad edit = nil; want error")
+	}
+
+	os.WriteFile(path, []byte(Fingerprint(key)+" # fixed\n"), 0600)
+
+	if _, err = keys.Authorize(key); err != nil || keys.Err() != nil {
+		t.Errorf("Authorize(key), Err() after a fix = %v, %v; want nil, nil", err, keys.Err())
+	}
+}
+
+func TestAuthorizedKeysSession(t *testing.T) {
+	var (
+		path      = filepath.Join(t.TempDir(), "authorized_keys")
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+	)
+
+	os.WriteFile(path, []byte(Fingerprint(clientKey.Public)+" command=backup # alice\n"), 0600)
+
+	keys, err := LoadAuthorizedKeys(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := handshakePair(t,
+		&Config{Keypair: &clientKey},
+		&Config{Keypair: &serverKey, AuthorizedKeys: keys},
+		nil,
+	)
+
+	if client.err != nil || server.err != nil {
+		t.Fatalf("RunClient() = %v, RunServer() = %v; want nil, nil", client.err, server.err)
+	}
+
+	if entry := server.session.AuthorizedKey(); entry == nil || entry.Command != "backup" {
+		t.Errorf("AuthorizedKey() = %+v; want command \"backup\"", entry)
+	}
+}
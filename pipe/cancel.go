@@ -0,0 +1,139 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "context"
+import "errors"
+import "time"
+
+var ErrHandshakeTimeout = errors.New("noise/pipe: handshake timed out")
+
+// A deadliner is a transport whose blocking operations can be
+// interrupted by a deadline, such as one backed by a net.Conn.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// A contextTransport makes each operation on a transport return early
+// once its context is done.
+type contextTransport struct {
+	ctx       context.Context
+	transport MessageTransport
+
+	// stops interrupting the transport once the context is done,
+	// reporting false if it already has been
+	stop func() bool
+}
+
+// Returns a transport bound to ctx, to be released once the handshake
+// is over. The transport's deadline is only changed to interrupt a
+// blocked operation once ctx is done, so any deadline the caller set is
+// left in place by a handshake that completes in time.
+func withContext(
+	ctx context.Context,
+	transport MessageTransport,
+) (
+	bound *contextTransport,
+) {
+	bound = &contextTransport{
+		ctx:       ctx,
+		transport: transport,
+		stop:      func() bool { return true },
+	}
+
+	if d, ok := transport.(deadliner); ok {
+		bound.stop = context.AfterFunc(ctx, func() {
+			d.SetDeadline(time.Unix(1, 0))
+		})
+	}
+
+	return bound
+}
+
+// Stops binding the transport to the context, passing the results of
+// the handshake through. A handshake that completed even though its
+// transport was interrupted is failed, since the transport's deadline
+// has been changed from under the caller.
+func (t *contextTransport) release(
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) (
+	ciphersuite.PublicKey,
+	*Session,
+	error,
+) {
+	if !t.stop() && err == nil {
+		session.Terminate()
+		return nil, nil, contextError(t.ctx.Err())
+	}
+
+	return peerKey, session, err
+}
+
+func (t *contextTransport) WriteMessage(msg []byte) error {
+	_, err := t.do(func() ([]byte, error) {
+		return nil, t.transport.WriteMessage(msg)
+	})
+
+	return err
+}
+
+func (t *contextTransport) ReadMessage() (msg []byte, err error) {
+	return t.do(t.transport.ReadMessage)
+}
+
+// Runs op, returning early once the context is done. An abandoned op
+// finishes in the background: transports with deadlines are
+// interrupted, but others run until the transport is closed.
+func (t *contextTransport) do(op func() ([]byte, error)) (msg []byte, err error) {
+	if err = t.ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
+	type result struct {
+		msg []byte
+		err error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		msg, err := op()
+		done <- result{msg, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.msg, t.check(r.err)
+	case <-t.ctx.Done():
+		return nil, contextError(t.ctx.Err())
+	}
+}
+
+// Attributes a failed operation to the context if it is done, since an
+// expired deadline surfaces as an I/O error.
+func (t *contextTransport) check(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if t.ctx.Err() != nil {
+		return contextError(t.ctx.Err())
+	}
+
+	// the transport's deadline may pass before the context notices
+	if deadline, ok := t.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return ErrHandshakeTimeout
+	}
+
+	return err
+}
+
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrHandshakeTimeout
+	}
+
+	return err
+}
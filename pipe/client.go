@@ -3,33 +3,170 @@ package pipe
 import "github.com/stouset/go.noise/box"
 import "github.com/stouset/go.noise/ciphersuite"
 
-type clientHandshake struct {
+import "io"
+
+// ClientHandshake performs the client side of a handshake.
+type ClientHandshake struct {
+	handshakeState
+
 	context box.Context
+	verify  PeerVerifier
+
+	// whether the handshake was abbreviated by EarlyEph
+	early bool
 }
 
 func NewClientHandshake(
 	suite ciphersuite.Ciphersuite,
 	clientKey *ciphersuite.Keypair,
 ) (
-	handshake *clientHandshake,
+	handshake *ClientHandshake,
 ) {
-	return &clientHandshake{
+	return &ClientHandshake{
 		context: *box.NewContext(suite, clientKey, 1),
 	}
 }
 
-func (h *clientHandshake) Eph() (eph []byte) {
-	return []byte(h.context.EphemeralPublicKey())
+// SetPeerVerifier makes Syn fail unless verify accepts the server's
+// key, so that the client's identity is never sent in Ack to a server
+// it doesn't trust.
+func (h *ClientHandshake) SetPeerVerifier(verify PeerVerifier) {
+	h.verify = verify
+}
+
+// SetEntropy makes the handshake draw its ephemeral keys from rand. It
+// must be called before the first step of the handshake.
+func (h *ClientHandshake) SetEntropy(rand io.Reader) error {
+	return h.context.SetEntropy(rand)
+}
+
+func (h *ClientHandshake) Eph() (eph []byte, err error) {
+	if err = h.expect(StateEph); err != nil {
+		return nil, err
+	}
+
+	h.state = StateSyn
+
+	return []byte(h.context.EphemeralPublicKey()), nil
+}
+
+// EarlyEph begins an abbreviated handshake with a server whose key is
+// already known. Instead of a bare ephemeral key, it returns a box shut
+// to serverKey carrying data, so the client can speak first. The
+// server's Syn then completes the handshake, and no Ack is sent.
+//
+// Unlike the rest of the session, data isn't forward secret and may be
+// replayed to the server by an attacker.
+func (h *ClientHandshake) EarlyEph(
+	serverKey ciphersuite.PublicKey,
+	data []byte,
+	padLen uint32,
+) (
+	eph []byte,
+	err error,
+) {
+	if err = h.expect(StateEph); err != nil {
+		return nil, err
+	}
+
+	h.context.Init(serverKey)
+
+	if eph, err = h.context.Shut(data, nil, 1, padLen); err != nil {
+		h.fail()
+		return nil, err
+	}
+
+	h.state = StateSyn
+	h.early = true
+
+	return eph, nil
 }
 
-func (h *clientHandshake) Syn(syn []byte) (data []byte, err error) {
-	return h.context.Open(syn, 1)
+// Bind mixes data into the handshake, so that it only completes if the
+// server binds the same data. It must be called between Eph and Syn.
+func (h *ClientHandshake) Bind(data []byte) error {
+	if err := h.expect(StateSyn); err != nil {
+		return err
+	}
+
+	h.context.MixChainVariable(data, kdfBind)
+
+	return nil
 }
 
-func (h *clientHandshake) Ack(data []byte, padLen uint32) (ack []byte) {
-	return h.context.Shut(data, 2, padLen)
+func (h *ClientHandshake) Syn(syn []byte) (data []byte, err error) {
+	if err = h.expect(StateSyn); err != nil {
+		return nil, err
+	}
+
+	if h.early {
+		data, err = h.context.OpenReply(syn, nil)
+	} else {
+		data, err = h.context.Open(syn, nil, 1)
+	}
+
+	if err != nil {
+		h.fail()
+		return nil, err
+	}
+
+	if h.verify != nil {
+		if err = h.verify(h.context.PeerPublicKey()); err != nil {
+			h.fail()
+			return nil, err
+		}
+	}
+
+	if h.early {
+		h.state = StateDone
+	} else {
+		h.state = StateAck
+	}
+
+	return data, nil
+}
+
+func (h *ClientHandshake) Ack(data []byte, padLen uint32) (ack []byte, err error) {
+	if err = h.expect(StateAck); err != nil {
+		return nil, err
+	}
+
+	if ack, err = h.context.Shut(data, nil, 2, padLen); err != nil {
+		h.fail()
+		return nil, err
+	}
+
+	h.state = StateDone
+
+	return ack, nil
+}
+
+// PeerPublicKey returns the server's static public key, once it has been
+// authenticated.
+func (h *ClientHandshake) PeerPublicKey() ciphersuite.PublicKey {
+	if h.state == StateFailed || h.state == StateTerminated {
+		return nil
+	}
+
+	return h.context.PeerPublicKey()
+}
+
+// Session returns a session for exchanging messages with the peer
+// over transport. The handshake must be done.
+func (h *ClientHandshake) Session(transport MessageTransport) (session *Session, err error) {
+	if err = h.expect(StateDone); err != nil {
+		return nil, err
+	}
+
+	return newSession(h.context.Suite(), transport, h.context.ChainVariable(), true), nil
+}
+
+func (h *ClientHandshake) Terminate() {
+	h.context.Terminate()
+	h.state = StateTerminated
 }
 
-func (h *clientHandshake) Terminate() {
+func (h *ClientHandshake) fail() {
 	h.context.Terminate()
+	h.state = StateFailed
 }
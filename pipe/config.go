@@ -0,0 +1,538 @@
+package pipe
+
+import "github.com/stouset/go.noise/box"
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "bufio"
+import "context"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+
+var (
+	ErrFrameSizeTooSmall = errors.New("noise/pipe: max frame size is too small for the ciphersuite")
+	ErrKeyLength         = errors.New("noise/pipe: keypair length doesn't match the ciphersuite")
+)
+
+// A Config holds the settings for a pipe's handshakes and the sessions
+// they establish. The same Config is taken by the dial, listen and
+// handshake functions, and mustn't be modified once passed to one. A
+// nil Config is treated like a zero one.
+type Config struct {
+	// Suites lists the ciphersuites that may be used, most preferred
+	// first. A client offers them all, and a server picks its most
+	// preferred one that's offered. If empty, Noise255 is used.
+	Suites []ciphersuite.Ciphersuite
+
+	// Protocols lists the application protocols spoken over the
+	// session, most preferred first. A server offers them all, and a
+	// client picks its most preferred one that's offered. Protocols
+	// are only negotiated by full handshakes.
+	Protocols []string
+
+	// Keypair is the static keypair identifying this side of the pipe.
+	// If nil, a new one is generated for each handshake.
+	Keypair *ciphersuite.Keypair
+
+	// ServerName, on a client, names the service to reach on a server
+	// hosting several.
+	ServerName string
+
+	// Hosts, on a server, maps the names of the services it hosts to
+	// the keypairs identifying them. Clients asking for a service that
+	// isn't listed, or for none, are served as Keypair.
+	Hosts map[string]*ciphersuite.Keypair
+
+	// VerifyPeer, if non-nil, aborts the handshake unless it accepts
+	// the peer's key.
+	VerifyPeer PeerVerifier
+
+	// AuthorizedKeys, if non-nil, makes a server abort the handshake
+	// unless the client's key is authorized, in addition to any
+	// VerifyPeer. The entry the key matched is kept on the session.
+	AuthorizedKeys *AuthorizedKeys
+
+	// Padding, if non-nil, returns how many bytes of padding to add to
+	// a handshake message carrying dataLen bytes of data.
+	Padding func(dataLen int) uint32
+
+	// HandshakeTimeout, if nonzero, bounds each handshake in addition
+	// to any context it is given.
+	HandshakeTimeout time.Duration
+
+	// KeepaliveInterval and IdleTimeout are set on each session, as by
+	// Session.SetKeepalive.
+	KeepaliveInterval time.Duration
+	IdleTimeout       time.Duration
+
+	// Rekey says when each session updates its keys.
+	Rekey RekeyPolicy
+
+	// MaxFrameSize, if nonzero, limits the size of the records each
+	// session sends and accepts, including their overhead. It can't
+	// exceed the transport's own limit, and must leave room for a key
+	// update record or a multiplexed frame with a byte of data. It
+	// isn't advertised to the peer, whose records larger than it are
+	// rejected, so the peer's must be no larger.
+	MaxFrameSize int
+
+	// Rand, if non-nil, is the entropy source ephemeral keys are drawn
+	// from. Otherwise the ciphersuite's own source is used.
+	Rand io.Reader
+
+	// Tickets, if non-nil, lets a server issue clients resumption
+	// tickets and accept them in place of a full handshake.
+	Tickets *TicketKeys
+}
+
+var ErrUnknownSuite = errors.New("noise/pipe: unknown ciphersuite")
+
+// LoadConfig reads a Config from a text file. Each line holds a
+// setting name followed by its value, separated by whitespace:
+//
+//	suite             Noise255
+//	protocol          echo/1
+//	keypair           <base64 private key> <base64 public key>
+//	host              mail <base64 private key> <base64 public key>
+//	server-name       mail
+//	authorized-keys   /etc/pipe/authorized_keys
+//	pin               SHA256:...
+//	padding           64
+//	handshake-timeout 10s
+//	keepalive         30s
+//	idle-timeout      5m
+//	rekey-messages    1000000
+//	rekey-bytes       1073741824
+//	rekey-interval    1h
+//	max-frame-size    16384
+//	tickets           24h
+//
+// The suite, protocol, host and pin settings may be repeated. Padding pads handshake
+// messages to a multiple of the given length, and tickets creates
+// ticket keys issuing tickets with the given lifetime. Blank lines and
+// lines beginning with '#' are ignored.
+func LoadConfig(path string) (config *Config, err error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var (
+		scanner = bufio.NewScanner(file)
+
+		pins           []string
+		ticketLifetime time.Duration
+	)
+
+	config = new(Config)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		switch fields[0] {
+		case "pin":
+			if len(fields) < 2 {
+				err = errors.New("pin takes one or more fingerprints")
+			}
+
+			pins = append(pins, fields[1:]...)
+		case "tickets":
+			ticketLifetime, err = parseConfigDuration(fields)
+		default:
+			err = config.set(fields)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("noise/pipe: %s:%d: %s", path, n, err)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, suite := range config.suites() {
+		if err = config.checkFrameSize(suite); err != nil {
+			return nil, fmt.Errorf("noise/pipe: %s: %s", path, err)
+		}
+
+		if err = config.checkKeyLen(suite); err != nil {
+			return nil, fmt.Errorf("noise/pipe: %s: %s", path, err)
+		}
+	}
+
+	if len(pins) > 0 {
+		config.VerifyPeer = PinFingerprints(pins...)
+	}
+
+	if ticketLifetime > 0 {
+		if config.Tickets, err = NewTicketKeys(config.suite(), ticketLifetime); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// Clone returns a copy of the Config, which may be modified without
+// affecting the original.
+func (c *Config) Clone() *Config {
+	if c == nil {
+		return new(Config)
+	}
+
+	clone := *c
+	clone.Suites = append([]ciphersuite.Ciphersuite(nil), c.Suites...)
+	clone.Protocols = append([]string(nil), c.Protocols...)
+
+	if c.Hosts != nil {
+		clone.Hosts = make(map[string]*ciphersuite.Keypair, len(c.Hosts))
+
+		for name, keypair := range c.Hosts {
+			clone.Hosts[name] = keypair
+		}
+	}
+
+	return &clone
+}
+
+// PadTo returns a padding policy for Config.Padding that pads each
+// message's data to a multiple of blockLen, hiding its exact length.
+func PadTo(blockLen int) func(dataLen int) uint32 {
+	return func(dataLen int) uint32 {
+		if rem := dataLen % blockLen; rem != 0 {
+			return uint32(blockLen - rem)
+		}
+
+		return 0
+	}
+}
+
+// Applies a single setting read from a config file.
+func (c *Config) set(fields []string) (err error) {
+	switch fields[0] {
+	case "suite":
+		if len(fields) != 2 {
+			return errors.New("suite takes a single name")
+		}
+
+		suite := ciphersuite.Lookup(fields[1])
+
+		if suite == nil {
+			return ErrUnknownSuite
+		}
+
+		c.Suites = append(c.Suites, suite)
+	case "protocol":
+		if len(fields) != 2 {
+			return errors.New("protocol takes a single name")
+		}
+
+		c.Protocols = append(c.Protocols, fields[1])
+	case "keypair":
+		if len(fields) != 3 {
+			return errors.New("keypair takes a private and public key")
+		}
+
+		c.Keypair, err = parseConfigKeypair(fields[1], fields[2])
+	case "host":
+		if len(fields) != 4 {
+			return errors.New("host takes a name and a private and public key")
+		}
+
+		if c.Hosts == nil {
+			c.Hosts = make(map[string]*ciphersuite.Keypair)
+		}
+
+		c.Hosts[fields[1]], err = parseConfigKeypair(fields[2], fields[3])
+	case "server-name":
+		if len(fields) != 2 {
+			return errors.New("server-name takes a single name")
+		}
+
+		c.ServerName = fields[1]
+	case "authorized-keys":
+		if len(fields) != 2 {
+			return errors.New("authorized-keys takes a single path")
+		}
+
+		c.AuthorizedKeys, err = LoadAuthorizedKeys(fields[1])
+	case "padding":
+		blockLen, err := parseConfigInt(fields)
+
+		if err != nil {
+			return err
+		}
+
+		c.Padding = PadTo(blockLen)
+	case "max-frame-size":
+		c.MaxFrameSize, err = parseConfigInt(fields)
+	case "rekey-messages":
+		c.Rekey.Messages, err = parseConfigUint(fields)
+	case "rekey-bytes":
+		c.Rekey.Bytes, err = parseConfigUint(fields)
+	case "rekey-interval":
+		c.Rekey.Interval, err = parseConfigDuration(fields)
+	case "handshake-timeout":
+		c.HandshakeTimeout, err = parseConfigDuration(fields)
+	case "keepalive":
+		c.KeepaliveInterval, err = parseConfigDuration(fields)
+	case "idle-timeout":
+		c.IdleTimeout, err = parseConfigDuration(fields)
+	default:
+		return fmt.Errorf("unknown setting %q", fields[0])
+	}
+
+	return err
+}
+
+func parseConfigKeypair(private string, public string) (keypair *ciphersuite.Keypair, err error) {
+	keypair = new(ciphersuite.Keypair)
+
+	if keypair.Private, err = base64.StdEncoding.DecodeString(private); err != nil {
+		return nil, err
+	}
+
+	if keypair.Public, err = base64.StdEncoding.DecodeString(public); err != nil {
+		return nil, err
+	}
+
+	return keypair, nil
+}
+
+func parseConfigInt(fields []string) (int, error) {
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("%s takes a single number", fields[0])
+	}
+
+	n, err := strconv.Atoi(fields[1])
+
+	if err == nil && n <= 0 {
+		err = fmt.Errorf("%s must be positive", fields[0])
+	}
+
+	return n, err
+}
+
+func parseConfigUint(fields []string) (uint64, error) {
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("%s takes a single number", fields[0])
+	}
+
+	return strconv.ParseUint(fields[1], 10, 64)
+}
+
+func parseConfigDuration(fields []string) (time.Duration, error) {
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("%s takes a single duration", fields[0])
+	}
+
+	return time.ParseDuration(fields[1])
+}
+
+func (c *Config) suites() []ciphersuite.Ciphersuite {
+	if len(c.Suites) == 0 {
+		return []ciphersuite.Ciphersuite{ciphersuite.Noise255}
+	}
+
+	return c.Suites
+}
+
+// The most preferred suite, used by handshakes that aren't negotiated.
+func (c *Config) suite() ciphersuite.Ciphersuite {
+	return c.suites()[0]
+}
+
+func (c *Config) padLen(dataLen int) uint32 {
+	if c.Padding == nil {
+		return 0
+	}
+
+	return c.Padding(dataLen)
+}
+
+func (c *Config) newKeypair(suite ciphersuite.Ciphersuite) (ciphersuite.Keypair, error) {
+	if c.Rand == nil {
+		return suite.NewKeypair(), nil
+	}
+
+	return suite.NewKeypairFrom(c.Rand)
+}
+
+// Bounds ctx by the handshake timeout.
+func (c *Config) handshakeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.HandshakeTimeout == 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, c.HandshakeTimeout)
+}
+
+func (c *Config) clientHandshake(suite ciphersuite.Ciphersuite) (*ClientHandshake, error) {
+	handshake := NewClientHandshake(suite, c.Keypair)
+	handshake.SetPeerVerifier(c.VerifyPeer)
+
+	if c.Rand != nil {
+		if err := handshake.SetEntropy(c.Rand); err != nil {
+			handshake.Terminate()
+			return nil, err
+		}
+	}
+
+	return handshake, nil
+}
+
+// The keypair identifying the service named serverName.
+func (c *Config) hostKeypair(serverName string) *ciphersuite.Keypair {
+	if keypair, ok := c.Hosts[serverName]; ok {
+		return keypair
+	}
+
+	return c.Keypair
+}
+
+// Every static keypair the server has, and the names of the services
+// they identify.
+func (c *Config) hostKeyring() (names []string, keyring box.Keyring) {
+	if c.Keypair != nil {
+		names = append(names, "")
+		keyring = append(keyring, c.Keypair)
+	}
+
+	for name, keypair := range c.Hosts {
+		names = append(names, name)
+		keyring = append(keyring, keypair)
+	}
+
+	return
+}
+
+// Returns a server handshake checking the client's key with
+// verifyClient, which leaves the authorized keys entry it matched in
+// authorized.
+func (c *Config) serverHandshake(
+	suite ciphersuite.Ciphersuite,
+	keypair *ciphersuite.Keypair,
+	authorized **AuthorizedKey,
+) (
+	*ServerHandshake,
+	error,
+) {
+	handshake := NewServerHandshake(suite, keypair)
+	handshake.SetPeerVerifier(func(key ciphersuite.PublicKey) (err error) {
+		*authorized, err = c.verifyClient(key)
+		return err
+	})
+
+	if c.Rand != nil {
+		if err := handshake.SetEntropy(c.Rand); err != nil {
+			handshake.Terminate()
+			return nil, err
+		}
+	}
+
+	return handshake, nil
+}
+
+// Checks a client's key against the authorized keys and VerifyPeer,
+// returning the authorized keys entry it matched.
+func (c *Config) verifyClient(key ciphersuite.PublicKey) (authorized *AuthorizedKey, err error) {
+	if c.AuthorizedKeys != nil {
+		if authorized, err = c.AuthorizedKeys.Authorize(key); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.VerifyPeer != nil {
+		if err = c.VerifyPeer(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return authorized, nil
+}
+
+// Checks that the keypairs read from a config file are the right
+// length for suite. Keys are decoded before the suites are all known, so
+// this can't be done as each is parsed.
+func (c *Config) checkKeyLen(suite ciphersuite.Ciphersuite) error {
+	keypairs := []*ciphersuite.Keypair{c.Keypair}
+
+	for _, keypair := range c.Hosts {
+		keypairs = append(keypairs, keypair)
+	}
+
+	for _, keypair := range keypairs {
+		if keypair == nil {
+			continue
+		}
+
+		if len(keypair.Private) != suite.DHLen() || len(keypair.Public) != suite.DHLen() {
+			return ErrKeyLength
+		}
+	}
+
+	return nil
+}
+
+// Checks that MaxFrameSize leaves room for every kind of record a
+// session using suite may send.
+func (c *Config) checkFrameSize(suite ciphersuite.Ciphersuite) error {
+	if c.MaxFrameSize > 0 && c.MaxFrameSize < minFrameSize(suite) {
+		return ErrFrameSizeTooSmall
+	}
+
+	return nil
+}
+
+// Applies the session settings to a newly established session, before
+// anything else is sent on it.
+func (c *Config) configure(
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) (
+	ciphersuite.PublicKey,
+	*Session,
+	error,
+) {
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = c.checkFrameSize(session.suite); err != nil {
+		session.Terminate()
+		return nil, nil, err
+	}
+
+	session.sendMu.Lock()
+	session.rand = c.Rand
+	session.policy = c.Rekey
+
+	if c.MaxFrameSize > 0 && c.MaxFrameSize < session.maxFrame {
+		session.maxFrame = c.MaxFrameSize
+	}
+
+	session.sendMu.Unlock()
+
+	if err = session.SetKeepalive(c.KeepaliveInterval, c.IdleTimeout); err != nil {
+		session.Terminate()
+		return nil, nil, err
+	}
+
+	return peerKey, session, nil
+}
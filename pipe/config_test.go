@@ -0,0 +1,205 @@
+package pipe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stouset/go.noise/ciphersuite"
+)
+
+func TestLoadConfig(t *testing.T) {
+	var (
+		key  = suite.NewKeypair()
+		path = filepath.Join(t.TempDir(), "config")
+
+		contents = "# pipe config\n" +
+			"suite Noise255\n" +
+			"protocol echo/1\n" +
+			"keypair " + base64.StdEncoding.EncodeToString(key.Private) + " " + base64.StdEncoding.EncodeToString(key.Public) + "\n" +
+			"pin " + Fingerprint(key.Public) + "\n" +
+			"padding 64\n" +
+			"idle-timeout 5m\n" +
+			"rekey-messages 1000\n" +
+			"max-frame-size 16384\n" +
+			"tickets 24h\n"
+	)
+
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(path)
+
+	if err != nil {
+		t.Fatalf("LoadConfig() = %v; want nil", err)
+	}
+
+	if len(config.Suites) != 1 || config.Suites[0] != ciphersuite.Noise255 {
+		t.Errorf("Suites = %v; want [Noise255]", config.Suites)
+	}
+
+	if len(config.Protocols) != 1 || config.Protocols[0] != "echo/1" {
+		t.Errorf("Protocols = %q; want [echo/1]", config.Protocols)
+	}
+
+	if !bytes.Equal(config.Keypair.Private, key.Private) || !bytes.Equal(config.Keypair.Public, key.Public) {
+		t.Error("Keypair doesn't match the file")
+	}
+
+	if config.VerifyPeer(key.Public) != nil || config.VerifyPeer(suite.NewKeypair().Public) == nil {
+		t.Error("VerifyPeer doesn't match the pinned key")
+	}
+
+	if config.Padding(10) != 54 {
+		t.Errorf("Padding(10) = %d; want 54", config.Padding(10))
+	}
+
+	if config.IdleTimeout != 5*time.Minute || config.Rekey.Messages != 1000 || config.MaxFrameSize != 16384 {
+		t.Errorf("IdleTimeout, Rekey.Messages, MaxFrameSize = %v, %d, %d; want 5m, 1000, 16384", config.IdleTimeout, config.Rekey.Messages, config.MaxFrameSize)
+	}
+
+	if config.Tickets == nil {
+		t.Error("Tickets = nil; want ticket keys")
+	}
+}
+
+func TestLoadConfigUnknownSetting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+
+	if err := os.WriteFile(path, []byte("frobnicate yes\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("LoadConfig(unknown setting) = nil; want error")
+	}
+}
+
+func TestLoadConfigFrameSizeTooSmall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+
+	if err := os.WriteFile(path, []byte("max-frame-size 16\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("LoadConfig(max-frame-size 16) = nil; want error")
+	}
+}
+
+func TestLoadConfigKeyLength(t *testing.T) {
+	var (
+		key   = suite.NewKeypair()
+		short = base64.StdEncoding.EncodeToString(key.Public[:16])
+		full  = base64.StdEncoding.EncodeToString(key.Public)
+	)
+
+	for _, line := range []string{
+		"keypair " + short + " " + full,
+		"keypair " + full + " " + short,
+		"host example.com " + full + " " + short,
+	} {
+		path := filepath.Join(t.TempDir(), "config")
+
+		if err := os.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("LoadConfig(%q) = nil; want error", line)
+		}
+	}
+}
+
+func TestLoadConfigEmptyPin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+
+	if err := os.WriteFile(path, []byte("pin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("LoadConfig(pin) = nil; want error")
+	}
+}
+
+func TestConfigFrameSizeTooSmall(t *testing.T) {
+	for _, size := range []int{16, minFrameSize(suite) - 1} {
+		session, _ := sessionPair()
+
+		if _, _, err := (&Config{MaxFrameSize: size}).configure(nil, session, nil); err != ErrFrameSizeTooSmall {
+			t.Errorf("configure(MaxFrameSize = %d) = %v; want %v", size, err, ErrFrameSizeTooSmall)
+		}
+	}
+
+	session, _ := sessionPair()
+	defer session.Terminate()
+
+	if _, _, err := (&Config{MaxFrameSize: minFrameSize(suite)}).configure(nil, session, nil); err != nil {
+		t.Errorf("configure(MaxFrameSize = %d) = %v; want nil", minFrameSize(suite), err)
+	}
+}
+
+func TestConfigSessionSettings(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+	)
+
+	config := &Config{
+		Keypair:      &clientKey,
+		Padding:      PadTo(32),
+		MaxFrameSize: 1024,
+		Rand:         rand.Reader,
+	}
+
+	client, server := handshakePair(t, config, &Config{Keypair: &serverKey, Rand: rand.Reader}, nil)
+
+	if client.err != nil || server.err != nil {
+		t.Fatalf("RunClient() = %v, RunServer() = %v; want nil, nil", client.err, server.err)
+	}
+
+	if err := client.session.WriteMessage(make([]byte, 1024)); err != ErrMessageTooLong {
+		t.Errorf("WriteMessage(1024 bytes) = %v; want %v", err, ErrMessageTooLong)
+	}
+}
+
+func TestConfigFrameSizeAppliesToTicket(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+	)
+
+	tickets, err := NewTicketKeys(suite, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &Config{
+		Keypair:      &serverKey,
+		Tickets:      tickets,
+		MaxFrameSize: minFrameSize(suite),
+	}
+
+	client, server := handshakePair(t, &Config{Keypair: &clientKey}, serverConfig, nil)
+
+	if client.err != nil || server.err != nil {
+		t.Fatalf("RunClient() = %v, RunServer() = %v; want nil, nil", client.err, server.err)
+	}
+
+	go server.session.WriteMessage([]byte("ping"))
+
+	if _, err := client.session.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage() = %v; want nil", err)
+	}
+
+	if ticket := client.session.Ticket(); ticket != nil {
+		t.Errorf("Ticket() = %v; want nil for a ticket larger than the frame limit", ticket)
+	}
+}
@@ -0,0 +1,253 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "context"
+import "net"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// How long Close waits to send the peer a close record.
+const closeTimeout = 5 * time.Second
+
+// Conn is a net.Conn whose traffic is carried by a session over an
+// underlying connection. A Conn returned by a Listener performs its
+// handshake on its first Read or Write, or when Handshake is called.
+type Conn struct {
+	net.Conn
+
+	// the handshake, run once under handshakeMu; session and peerKey
+	// are only set once handshakeDone is
+	handshakeMu   sync.Mutex
+	handshake     func(ctx context.Context, transport MessageTransport, config *Config) (ciphersuite.PublicKey, *Session, error)
+	handshakeErr  error
+	handshakeDone atomic.Bool
+	config        *Config
+
+	session *Session
+	peerKey ciphersuite.PublicKey
+
+	// the unread remainder of the last message received
+	readBuf []byte
+}
+
+// Client performs the client side of a handshake over conn.
+func Client(conn net.Conn, config *Config) (c *Conn, err error) {
+	return ClientContext(context.Background(), conn, config)
+}
+
+func ClientContext(
+	ctx context.Context,
+	conn net.Conn,
+	config *Config,
+) (
+	c *Conn,
+	err error,
+) {
+	c = &Conn{Conn: conn, handshake: RunClientContext, config: config}
+
+	if err = c.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Server performs the server side of a handshake over conn.
+func Server(conn net.Conn, config *Config) (c *Conn, err error) {
+	return ServerContext(context.Background(), conn, config)
+}
+
+func ServerContext(
+	ctx context.Context,
+	conn net.Conn,
+	config *Config,
+) (
+	c *Conn,
+	err error,
+) {
+	c = newServerConn(conn, config)
+
+	if err = c.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Returns a Conn that performs the server side of a handshake when
+// it's first used.
+func newServerConn(conn net.Conn, config *Config) *Conn {
+	return &Conn{Conn: conn, handshake: RunServerContext, config: config}
+}
+
+// Dial connects to address and performs the client side of a
+// handshake over the connection.
+func Dial(
+	network string,
+	address string,
+	config *Config,
+) (
+	c *Conn,
+	err error,
+) {
+	return DialContext(context.Background(), network, address, config)
+}
+
+// DialContext is like Dial, but gives up on both connecting and the
+// handshake once ctx is done.
+func DialContext(
+	ctx context.Context,
+	network string,
+	address string,
+	config *Config,
+) (
+	c *Conn,
+	err error,
+) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, network, address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c, err = ClientContext(ctx, conn, config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Handshake performs the connection's handshake if it hasn't been
+// already, returning its error if it failed. It is called by the first
+// Read or Write.
+func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext is like Handshake, but gives up once ctx is done.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+
+	if c.handshakeDone.Load() || c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+
+	peerKey, session, err := c.handshake(ctx, NewStreamTransport(c.Conn), c.config)
+
+	if err != nil {
+		c.handshakeErr = err
+		return err
+	}
+
+	c.session, c.peerKey = session, peerKey
+	c.handshakeDone.Store(true)
+
+	return nil
+}
+
+// PeerPublicKey returns the peer's authenticated static public key, or
+// nil if the handshake hasn't completed.
+func (c *Conn) PeerPublicKey() ciphersuite.PublicKey {
+	if !c.handshakeDone.Load() {
+		return nil
+	}
+
+	return c.peerKey
+}
+
+// Session returns the session carrying the connection's traffic, or nil
+// if the handshake hasn't completed.
+func (c *Conn) Session() *Session {
+	if !c.handshakeDone.Load() {
+		return nil
+	}
+
+	return c.session
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	if err = c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	for len(c.readBuf) == 0 {
+		if c.readBuf, err = c.session.ReadMessage(); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	if err = c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	chunkLen := c.session.maxDataLen()
+
+	for len(b) > 0 {
+		chunk := b
+
+		if len(chunk) > chunkLen {
+			chunk = chunk[:chunkLen]
+		}
+
+		if err = c.session.WriteMessage(chunk); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// CloseWrite tells the peer that nothing more will be written, and
+// shuts down the writing side of the underlying connection if it
+// supports doing so. The connection can still be read from.
+func (c *Conn) CloseWrite() error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+
+	if err := c.session.CloseWrite(); err != nil {
+		return err
+	}
+
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// Close tells the peer the connection is closing, then closes the
+// underlying connection and wipes the session. Any pending Read or
+// Write is interrupted.
+func (c *Conn) Close() error {
+	// closing the connection interrupts a handshake in progress
+	if !c.handshakeDone.Load() {
+		return c.Conn.Close()
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.session.CloseWrite()
+
+	// a pending Read holds the session's lock until the connection
+	// is closed under it
+	err := c.Conn.Close()
+	c.session.Terminate()
+
+	return err
+}
@@ -0,0 +1,144 @@
+package pipe
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func connPair(t *testing.T) (client *Conn, server *Conn) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+
+		clientConn, serverConn = net.Pipe()
+
+		done = make(chan error)
+	)
+
+	go func() {
+		var err error
+
+		server, err = Server(serverConn, &Config{Keypair: &serverKey})
+		done <- err
+	}()
+
+	client, err := Client(clientConn, &Config{Keypair: &clientKey})
+
+	if err := <-done; err != nil {
+		t.Fatalf("Server() = %v; want nil", err)
+	}
+
+	if err != nil {
+		t.Fatalf("Client() = %v; want nil", err)
+	}
+
+	// net.Pipe is unbuffered, so the server drains the client's close
+	// record for the client's Close not to wait on it
+	t.Cleanup(func() {
+		drained := make(chan struct{})
+
+		go func() {
+			io.Copy(io.Discard, server)
+			close(drained)
+		}()
+
+		client.Close()
+		<-drained
+		server.Close()
+	})
+
+	return
+}
+
+func TestConnReadWrite(t *testing.T) {
+	var (
+		client, server = connPair(t)
+
+		data = bytes.Repeat([]byte("data"), maxMessageLen/2)
+	)
+
+	go client.Write(data)
+
+	out := make([]byte, len(data))
+
+	if _, err := io.ReadFull(server, out); err != nil {
+		t.Fatalf("ReadFull() = %v; want nil", err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Error("ReadFull() doesn't match data written")
+	}
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	client, server := connPair(t)
+
+	go func() {
+		client.Write([]byte("request"))
+		client.CloseWrite()
+	}()
+
+	request, err := io.ReadAll(server)
+
+	if err != nil || !bytes.Equal(request, []byte("request")) {
+		t.Fatalf("ReadAll(server) = %q, %v; want \"request\", nil", request, err)
+	}
+
+	go server.Write([]byte("response"))
+
+	response := make([]byte, len("response"))
+
+	if _, err := io.ReadFull(client, response); err != nil || !bytes.Equal(response, []byte("response")) {
+		t.Errorf("ReadFull(client) = %q, %v; want \"response\", nil", response, err)
+	}
+}
+
+func TestConnTruncated(t *testing.T) {
+	client, server := connPair(t)
+
+	client.Conn.Close()
+
+	if _, err := server.Read(make([]byte, 1)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Read() after truncation = %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestConnClosePendingRead(t *testing.T) {
+	var (
+		client, server = connPair(t)
+
+		read    = make(chan error)
+		closed  = make(chan error)
+		drained = make(chan struct{})
+	)
+
+	go func() {
+		_, err := client.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	go func() {
+		io.Copy(io.Discard, server)
+		close(drained)
+	}()
+
+	// give the Read time to block
+	time.Sleep(10 * time.Millisecond)
+
+	go func() { closed <- client.Close() }()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close() with a pending Read didn't return")
+	}
+
+	if err := <-read; err == nil {
+		t.Error("pending Read() after Close() = nil; want error")
+	}
+
+	<-drained
+}
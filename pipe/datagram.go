@@ -0,0 +1,314 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "encoding/binary"
+import "errors"
+import "math"
+import "net"
+import "sync"
+import "time"
+
+// Each packet starts with the 8-byte little-endian counter its key was
+// derived from.
+const packetCounterLen = 8
+
+// The largest datagram read from a PacketConn.
+const maxPacketLen = 1 << 16
+
+var (
+	ErrReplayedPacket   = errors.New("noise/pipe: packet was replayed or is too old")
+	ErrCounterExhausted = errors.New("noise/pipe: packet counter is exhausted")
+)
+
+// A DatagramSession exchanges encrypted packets with the peer over an
+// unreliable transport, such as UDP. Unlike a Session, packets may be
+// lost or reordered without breaking the session: each is encrypted
+// under its own key, derived from an explicit counter it carries.
+// Packets are rejected if they are replayed, or fall too far behind
+// the newest one received.
+type DatagramSession struct {
+	suite ciphersuite.Ciphersuite
+
+	sendMu      sync.Mutex
+	sendChain   ciphersuite.ChainVariable
+	sendCounter uint64
+
+	recvMu    sync.Mutex
+	recvChain ciphersuite.ChainVariable
+	window    replayWindow
+}
+
+// A replayWindow tracks which of the last 64 counters up to top have
+// been received.
+type replayWindow struct {
+	top  uint64
+	seen uint64
+}
+
+// NewDatagramSession derives a datagram session from the keys of an
+// established session, which is terminated. The handshake itself may
+// have been performed over a packet transport.
+func NewDatagramSession(session *Session) *DatagramSession {
+	session.sendMu.Lock()
+
+	var (
+		suite = session.suite
+		cv    = session.chain
+
+		clientChain, clientCC = suite.DeriveCVCC(suite.NewChain(), ciphersuite.SymmetricKey(cv), kdfDatagramClient)
+		serverChain, serverCC = suite.DeriveCVCC(suite.NewChain(), ciphersuite.SymmetricKey(cv), kdfDatagramServer)
+
+		d = &DatagramSession{
+			suite:     suite,
+			sendChain: clientChain,
+			recvChain: serverChain,
+		}
+	)
+
+	if !session.client {
+		d.sendChain, d.recvChain = serverChain, clientChain
+	}
+
+	session.sendMu.Unlock()
+	session.Terminate()
+
+	wipe(clientCC)
+	wipe(serverCC)
+
+	return d
+}
+
+// Seal encrypts data into a packet for the peer.
+func (d *DatagramSession) Seal(data []byte) (packet []byte, err error) {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	if d.sendChain == nil {
+		return nil, ErrSessionTerminated
+	}
+
+	if d.sendCounter == math.MaxUint64 {
+		return nil, ErrCounterExhausted
+	}
+
+	counter := d.sendCounter
+	d.sendCounter++
+
+	packet = make([]byte, packetCounterLen, packetCounterLen+len(data)+d.suite.MACLen())
+	binary.LittleEndian.PutUint64(packet, counter)
+
+	cc := d.packetCC(d.sendChain, packet[:packetCounterLen])
+	defer wipe(cc)
+
+	return append(packet, d.suite.Encrypt(cc, data, packet[:packetCounterLen])...), nil
+}
+
+// Open decrypts a packet from the peer. A packet that has already been
+// opened, or that is too old to tell, is rejected with
+// ErrReplayedPacket.
+func (d *DatagramSession) Open(packet []byte) (data []byte, err error) {
+	d.recvMu.Lock()
+	defer d.recvMu.Unlock()
+
+	if d.recvChain == nil {
+		return nil, ErrSessionTerminated
+	}
+
+	if len(packet) < packetCounterLen+d.suite.MACLen() {
+		return nil, ErrShortMessage
+	}
+
+	counter := binary.LittleEndian.Uint64(packet)
+
+	if !d.window.check(counter) {
+		return nil, ErrReplayedPacket
+	}
+
+	cc := d.packetCC(d.recvChain, packet[:packetCounterLen])
+	defer wipe(cc)
+
+	if data, err = d.suite.Decrypt(cc, packet[packetCounterLen:], packet[:packetCounterLen]); err != nil {
+		return nil, err
+	}
+
+	// only authentic packets move the window
+	d.window.update(counter)
+
+	return data, nil
+}
+
+// Terminate wipes the session's keys. The session can't be used
+// afterward.
+func (d *DatagramSession) Terminate() {
+	d.recvMu.Lock()
+	d.sendMu.Lock()
+	defer d.recvMu.Unlock()
+	defer d.sendMu.Unlock()
+
+	wipe(d.sendChain)
+	wipe(d.recvChain)
+
+	d.sendChain = nil
+	d.recvChain = nil
+}
+
+// Derives the key for a single packet from the chain for its direction.
+func (d *DatagramSession) packetCC(
+	chain ciphersuite.ChainVariable,
+	counter []byte,
+) (
+	cc ciphersuite.CipherContext,
+) {
+	cv, cc := d.suite.DeriveCVCC(ciphersuite.ChainVariable(counter), ciphersuite.SymmetricKey(chain), kdfDatagramPacket)
+	wipe(cv)
+
+	return cc
+}
+
+// Reports whether counter is new.
+func (w *replayWindow) check(counter uint64) bool {
+	if counter > w.top {
+		return true
+	}
+
+	if w.top-counter >= 64 {
+		return false
+	}
+
+	return w.seen&(1<<(w.top-counter)) == 0
+}
+
+// Marks counter as received.
+func (w *replayWindow) update(counter uint64) {
+	if counter <= w.top {
+		w.seen |= 1 << (w.top - counter)
+		return
+	}
+
+	if shift := counter - w.top; shift < 64 {
+		w.seen = w.seen<<shift | 1
+	} else {
+		w.seen = 1
+	}
+
+	w.top = counter
+}
+
+// A DatagramConn is a net.Conn exchanging packets of a datagram
+// session with a single peer over a PacketConn. Each Write is sent as
+// one packet, and each Read returns the data of one packet, silently
+// dropping any from other addresses or that can't be opened.
+type DatagramConn struct {
+	conn    net.PacketConn
+	addr    net.Addr
+	session *DatagramSession
+}
+
+func NewDatagramConn(
+	conn net.PacketConn,
+	addr net.Addr,
+	session *DatagramSession,
+) (
+	c *DatagramConn,
+) {
+	return &DatagramConn{conn: conn, addr: addr, session: session}
+}
+
+// Session returns the datagram session carrying the connection's
+// traffic.
+func (c *DatagramConn) Session() *DatagramSession {
+	return c.session
+}
+
+func (c *DatagramConn) Read(b []byte) (n int, err error) {
+	buf := make([]byte, maxPacketLen)
+
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if addr.String() != c.addr.String() {
+			continue
+		}
+
+		data, err := c.session.Open(buf[:n])
+
+		if err == ErrSessionTerminated {
+			return 0, err
+		}
+
+		if err == nil {
+			return copy(b, data), nil
+		}
+	}
+}
+
+func (c *DatagramConn) Write(b []byte) (n int, err error) {
+	packet, err := c.session.Seal(b)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = c.conn.WriteTo(packet, c.addr); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Close wipes the session and closes the underlying PacketConn.
+func (c *DatagramConn) Close() error {
+	c.session.Terminate()
+
+	return c.conn.Close()
+}
+
+func (c *DatagramConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *DatagramConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *DatagramConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *DatagramConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *DatagramConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+type packetTransport struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+// NewPacketTransport returns a MessageTransport that sends each message
+// as a single packet to addr over conn, ignoring packets from anywhere
+// else. Lost packets aren't retransmitted, so a handshake over it
+// should be bounded by a context.
+func NewPacketTransport(conn net.PacketConn, addr net.Addr) MessageTransport {
+	return &packetTransport{conn: conn, addr: addr}
+}
+
+func (t *packetTransport) WriteMessage(msg []byte) error {
+	_, err := t.conn.WriteTo(msg, t.addr)
+
+	return err
+}
+
+func (t *packetTransport) ReadMessage() (msg []byte, err error) {
+	buf := make([]byte, maxPacketLen)
+
+	for {
+		n, addr, err := t.conn.ReadFrom(buf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if addr.String() == t.addr.String() {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (t *packetTransport) SetDeadline(deadline time.Time) error {
+	return t.conn.SetDeadline(deadline)
+}
@@ -0,0 +1,106 @@
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func datagramPair() (client *DatagramSession, server *DatagramSession) {
+	clientSession, serverSession := sessionPair()
+
+	return NewDatagramSession(clientSession), NewDatagramSession(serverSession)
+}
+
+func TestDatagramReordered(t *testing.T) {
+	client, server := datagramPair()
+
+	var packets [][]byte
+
+	for _, data := range []string{"a", "b", "c"} {
+		packet, _ := client.Seal([]byte(data))
+		packets = append(packets, packet)
+	}
+
+	for i, want := range []string{"c", "a", "b"} {
+		data, err := server.Open(packets[(i+2)%3])
+
+		if err != nil || !bytes.Equal(data, []byte(want)) {
+			t.Errorf("Open(packet) = %q, %v; want %q, nil", data, err, want)
+		}
+	}
+
+	if _, err := server.Open(packets[0]); err != ErrReplayedPacket {
+		t.Errorf("Open(replayed) = %v; want %v", err, ErrReplayedPacket)
+	}
+}
+
+func TestDatagramTooOld(t *testing.T) {
+	client, server := datagramPair()
+
+	old, _ := client.Seal([]byte("old"))
+
+	for i := 0; i < 64; i++ {
+		packet, _ := client.Seal(nil)
+		server.Open(packet)
+	}
+
+	if _, err := server.Open(old); err != ErrReplayedPacket {
+		t.Errorf("Open(old) = %v; want %v", err, ErrReplayedPacket)
+	}
+}
+
+func TestDatagramConn(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+	)
+
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Skip(err)
+	}
+
+	defer clientConn.Close()
+
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Skip(err)
+	}
+
+	defer serverConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan *Session)
+
+	go func() {
+		_, session, _ := RunServerContext(ctx, NewPacketTransport(serverConn, clientConn.LocalAddr()), &Config{Keypair: &serverKey})
+		done <- session
+	}()
+
+	_, session, err := RunClientContext(ctx, NewPacketTransport(clientConn, serverConn.LocalAddr()), &Config{Keypair: &clientKey})
+
+	if err != nil {
+		t.Fatalf("RunClientContext() = %v; want nil", err)
+	}
+
+	var (
+		client = NewDatagramConn(clientConn, serverConn.LocalAddr(), NewDatagramSession(session))
+		server = NewDatagramConn(serverConn, clientConn.LocalAddr(), NewDatagramSession(<-done))
+	)
+
+	client.Write([]byte("ping"))
+
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+
+	if err != nil || !bytes.Equal(buf[:n], []byte("ping")) {
+		t.Errorf("Read() = %q, %v; want \"ping\", nil", buf[:n], err)
+	}
+}
@@ -0,0 +1,81 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "encoding/binary"
+import "errors"
+
+// The longest label or context, and the most keying material, that can
+// be exported at once.
+const (
+	maxExportInfoLen = 0xffff
+	maxExportLen     = ciphersuite.MaxDeriveKeyLen
+)
+
+var ErrExportTooLong = errors.New("noise/pipe: exported label, context or length too long")
+
+// ChannelBinding returns a value unique to the handshake that
+// established the session, which both sides share. Higher-level
+// protocols can bind authentication, such as a token or password
+// exchange, to the session by including it, so that it can't be
+// replayed over another session. It isn't secret.
+func (s *Session) ChannelBinding() []byte {
+	return append([]byte(nil), s.binding...)
+}
+
+// ExportKeyingMaterial derives length bytes of keying material shared
+// with the peer, distinct for each label and context and from the
+// session's own keys. It is derived from the handshake, so it doesn't
+// change when the session's keys are updated.
+func (s *Session) ExportKeyingMaterial(
+	label string,
+	context []byte,
+	length int,
+) (
+	material []byte,
+	err error,
+) {
+	if len(label) > maxExportInfoLen || len(context) > maxExportInfoLen || length < 0 || length > maxExportLen {
+		return nil, ErrExportTooLong
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if s.exporter == nil {
+		return nil, s.terminated()
+	}
+
+	// length-prefix the label and context, so that no two pairs of
+	// them give the same info
+	info := make([]byte, 2+len(label)+2+len(context))
+
+	binary.LittleEndian.PutUint16(info, uint16(len(label)))
+	copy(info[2:], label)
+	binary.LittleEndian.PutUint16(info[2+len(label):], uint16(len(context)))
+	copy(info[2+len(label)+2:], context)
+
+	return s.suite.DeriveKey(s.exporter, info, length), nil
+}
+
+func exporterSecret(
+	suite ciphersuite.Ciphersuite,
+	cv ciphersuite.ChainVariable,
+) (
+	secret ciphersuite.ChainVariable,
+) {
+	secret, _ = suite.DeriveCVCC(suite.NewChain(), ciphersuite.SymmetricKey(cv), kdfExporter)
+
+	return
+}
+
+func channelBinding(
+	suite ciphersuite.Ciphersuite,
+	cv ciphersuite.ChainVariable,
+) (
+	binding []byte,
+) {
+	binding, _ = suite.DeriveCVCC(suite.NewChain(), ciphersuite.SymmetricKey(cv), kdfBinding)
+
+	return
+}
@@ -0,0 +1,70 @@
+package pipe
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChannelBinding(t *testing.T) {
+	client, server := runPair(t)
+	other, _ := runPair(t)
+
+	if !bytes.Equal(client.session.ChannelBinding(), server.session.ChannelBinding()) {
+		t.Error("ChannelBinding() differs between the client and server")
+	}
+
+	if bytes.Equal(client.session.ChannelBinding(), other.session.ChannelBinding()) {
+		t.Error("ChannelBinding() is the same for different sessions")
+	}
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	client, server := sessionPair()
+
+	clientKey, err := client.ExportKeyingMaterial("token", []byte("ctx"), 32)
+
+	if err != nil || len(clientKey) != 32 {
+		t.Fatalf("ExportKeyingMaterial() = %x, %v; want 32 bytes, nil", clientKey, err)
+	}
+
+	if serverKey, _ := server.ExportKeyingMaterial("token", []byte("ctx"), 32); !bytes.Equal(clientKey, serverKey) {
+		t.Errorf("ExportKeyingMaterial() = %x on the server; want %x", serverKey, clientKey)
+	}
+
+	for _, args := range []struct {
+		label   string
+		context string
+	}{
+		{"token2", "ctx"},
+		{"token", "ctx2"},
+		{"tokenc", "tx"},
+	} {
+		if key, _ := client.ExportKeyingMaterial(args.label, []byte(args.context), 32); bytes.Equal(key, clientKey) {
+			t.Errorf("ExportKeyingMaterial(%q, %q) = ExportKeyingMaterial(\"token\", \"ctx\")", args.label, args.context)
+		}
+	}
+
+	if err = client.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, _ := client.ExportKeyingMaterial("token", []byte("ctx"), 32); !bytes.Equal(key, clientKey) {
+		t.Error("ExportKeyingMaterial() changed after Rekey()")
+	}
+
+	for _, length := range []int{193, 1000, maxExportLen} {
+		if key, err := client.ExportKeyingMaterial("token", nil, length); err != nil || len(key) != length {
+			t.Errorf("len(ExportKeyingMaterial(%d)) = %d, %v; want %d, nil", length, len(key), err, length)
+		}
+	}
+
+	if _, err = client.ExportKeyingMaterial("token", nil, maxExportLen+1); err != ErrExportTooLong {
+		t.Errorf("ExportKeyingMaterial(too long) = %v; want %v", err, ErrExportTooLong)
+	}
+
+	client.Terminate()
+
+	if _, err = client.ExportKeyingMaterial("token", nil, 32); err != ErrSessionTerminated {
+		t.Errorf("ExportKeyingMaterial() after Terminate() = %v; want %v", err, ErrSessionTerminated)
+	}
+}
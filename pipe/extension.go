@@ -0,0 +1,232 @@
+package pipe
+
+import "encoding/binary"
+import "errors"
+
+// The data in the server's Syn and the client's Ack is a sequence of
+// extensions, each a 2-byte little-endian type and length followed by
+// that many bytes of data. Types that aren't understood are ignored.
+const (
+	// Data sent by the client in its Ack, which becomes the first
+	// message on the session.
+	ExtensionData = 0
+
+	// The application protocols the server speaks, most preferred
+	// first, each preceded by a byte giving its length.
+	ExtensionProtocols = 1
+
+	// The application protocol the client picked from those offered.
+	ExtensionProtocol = 2
+)
+
+const extensionHeaderLen = 4
+
+var (
+	ErrMalformedExtensions = errors.New("noise/pipe: malformed handshake extensions")
+	ErrExtensionTooLong    = errors.New("noise/pipe: handshake extension too long")
+	ErrNoCommonProtocol    = errors.New("noise/pipe: no application protocol in common with the peer")
+)
+
+// An Extension is a single typed entry in a handshake message's data.
+type Extension struct {
+	Type uint16
+	Data []byte
+}
+
+// MarshalExtensions encodes extensions as the data for a handshake
+// message.
+func MarshalExtensions(extensions []Extension) (data []byte, err error) {
+	for _, extension := range extensions {
+		if len(extension.Data) > 0xffff {
+			return nil, ErrExtensionTooLong
+		}
+
+		header := make([]byte, extensionHeaderLen)
+		binary.LittleEndian.PutUint16(header, extension.Type)
+		binary.LittleEndian.PutUint16(header[2:], uint16(len(extension.Data)))
+
+		data = append(append(data, header...), extension.Data...)
+	}
+
+	return data, nil
+}
+
+// ParseExtensions decodes the data of a handshake message. A type may
+// appear at most once.
+func ParseExtensions(data []byte) (extensions []Extension, err error) {
+	seen := make(map[uint16]bool)
+
+	for len(data) > 0 {
+		if len(data) < extensionHeaderLen {
+			return nil, ErrMalformedExtensions
+		}
+
+		var (
+			extensionType = binary.LittleEndian.Uint16(data)
+			extensionLen  = int(binary.LittleEndian.Uint16(data[2:]))
+		)
+
+		if len(data) < extensionHeaderLen+extensionLen || seen[extensionType] {
+			return nil, ErrMalformedExtensions
+		}
+
+		seen[extensionType] = true
+		extensions = append(extensions, Extension{
+			Type: extensionType,
+			Data: data[extensionHeaderLen : extensionHeaderLen+extensionLen],
+		})
+
+		data = data[extensionHeaderLen+extensionLen:]
+	}
+
+	return extensions, nil
+}
+
+// Returns the data of the extension of the given type, if present.
+func findExtension(extensions []Extension, extensionType uint16) (data []byte, ok bool) {
+	for _, extension := range extensions {
+		if extension.Type == extensionType {
+			return extension.Data, true
+		}
+	}
+
+	return nil, false
+}
+
+func encodeProtocols(protocols []string) (data []byte, err error) {
+	for _, protocol := range protocols {
+		if len(protocol) == 0 || len(protocol) > 255 {
+			return nil, ErrExtensionTooLong
+		}
+
+		data = append(append(data, byte(len(protocol))), protocol...)
+	}
+
+	return data, nil
+}
+
+func parseProtocols(data []byte) (protocols []string, err error) {
+	for len(data) > 0 {
+		protocolLen := int(data[0])
+
+		if protocolLen == 0 || len(data) < 1+protocolLen {
+			return nil, ErrMalformedExtensions
+		}
+
+		protocols = append(protocols, string(data[1:1+protocolLen]))
+		data = data[1+protocolLen:]
+	}
+
+	return protocols, nil
+}
+
+// Picks the client's most preferred protocol among those the server
+// offered. No protocol is picked if either side has none.
+func (c *Config) selectProtocol(offered []string) (protocol string, err error) {
+	if len(c.Protocols) == 0 || len(offered) == 0 {
+		return "", nil
+	}
+
+	for _, protocol := range c.Protocols {
+		for _, name := range offered {
+			if protocol == name {
+				return protocol, nil
+			}
+		}
+	}
+
+	return "", ErrNoCommonProtocol
+}
+
+// The data of the server's Syn, offering its protocols.
+func (c *Config) synExtensions() (data []byte, err error) {
+	if len(c.Protocols) == 0 {
+		return nil, nil
+	}
+
+	protocols, err := encodeProtocols(c.Protocols)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return MarshalExtensions([]Extension{{Type: ExtensionProtocols, Data: protocols}})
+}
+
+// Reads the server's Syn data and returns the client's Ack data,
+// carrying data and the protocol picked.
+func (c *Config) ackExtensions(
+	syn []byte,
+	data []byte,
+) (
+	ack []byte,
+	protocol string,
+	err error,
+) {
+	var (
+		extensions []Extension
+		offered    []string
+	)
+
+	if extensions, err = ParseExtensions(syn); err != nil {
+		return nil, "", err
+	}
+
+	if protocols, ok := findExtension(extensions, ExtensionProtocols); ok {
+		if offered, err = parseProtocols(protocols); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if protocol, err = c.selectProtocol(offered); err != nil {
+		return nil, "", err
+	}
+
+	extensions = nil
+
+	if len(data) > 0 {
+		extensions = append(extensions, Extension{Type: ExtensionData, Data: data})
+	}
+
+	if protocol != "" {
+		extensions = append(extensions, Extension{Type: ExtensionProtocol, Data: []byte(protocol)})
+	}
+
+	if ack, err = MarshalExtensions(extensions); err != nil {
+		return nil, "", err
+	}
+
+	return ack, protocol, nil
+}
+
+// Reads the client's Ack data, returning the data it carries and the
+// protocol it picked, which must be one the server offered.
+func (c *Config) readAckExtensions(
+	ack []byte,
+) (
+	data []byte,
+	protocol string,
+	err error,
+) {
+	extensions, err := ParseExtensions(ack)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, _ = findExtension(extensions, ExtensionData)
+
+	picked, ok := findExtension(extensions, ExtensionProtocol)
+
+	if !ok {
+		return data, "", nil
+	}
+
+	for _, protocol := range c.Protocols {
+		if protocol == string(picked) {
+			return data, protocol, nil
+		}
+	}
+
+	return nil, "", ErrUnexpectedMessage
+}
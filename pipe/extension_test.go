@@ -0,0 +1,125 @@
+package pipe
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtensionsRoundTrip(t *testing.T) {
+	extensions := []Extension{
+		{Type: ExtensionData, Data: []byte("hello")},
+		{Type: 0x1234, Data: nil},
+	}
+
+	data, err := MarshalExtensions(extensions)
+
+	if err != nil {
+		t.Fatalf("MarshalExtensions() = %v; want nil", err)
+	}
+
+	parsed, err := ParseExtensions(data)
+
+	if err != nil || len(parsed) != 2 {
+		t.Fatalf("ParseExtensions() = %v, %v; want 2 extensions, nil", parsed, err)
+	}
+
+	for i := range extensions {
+		if parsed[i].Type != extensions[i].Type || !bytes.Equal(parsed[i].Data, extensions[i].Data) {
+			t.Errorf("ParseExtensions()[%d] = %v; want %v", i, parsed[i], extensions[i])
+		}
+	}
+}
+
+func TestParseExtensionsMalformed(t *testing.T) {
+	duplicated, _ := MarshalExtensions([]Extension{{Type: 1}, {Type: 1}})
+
+	for _, data := range [][]byte{
+		{0x01},
+		{0x01, 0x00, 0x05, 0x00, 'a'},
+		duplicated,
+	} {
+		if _, err := ParseExtensions(data); err != ErrMalformedExtensions {
+			t.Errorf("ParseExtensions(%x) = %v; want %v", data, err, ErrMalformedExtensions)
+		}
+	}
+}
+
+func protocolPair(
+	t *testing.T,
+	clientProtocols []string,
+	serverProtocols []string,
+) (
+	client runResult,
+	server runResult,
+) {
+	return handshakePair(t, &Config{Protocols: clientProtocols}, &Config{Protocols: serverProtocols}, nil)
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	for _, test := range []struct {
+		client, server []string
+		want           string
+	}{
+		{[]string{"b", "a"}, []string{"a", "b"}, "b"},
+		{[]string{"a"}, []string{"c", "a"}, "a"},
+		{nil, []string{"a"}, ""},
+		{[]string{"a"}, nil, ""},
+	} {
+		client, server := protocolPair(t, test.client, test.server)
+
+		if client.err != nil || server.err != nil {
+			t.Fatalf("RunClient() = %v, RunServer() = %v; want nil, nil", client.err, server.err)
+		}
+
+		if client.session.Protocol() != test.want || server.session.Protocol() != test.want {
+			t.Errorf("Protocol() = %q, %q; want %q", client.session.Protocol(), server.session.Protocol(), test.want)
+		}
+	}
+}
+
+func TestNoCommonProtocol(t *testing.T) {
+	client, server := protocolPair(t, []string{"a"}, []string{"b"})
+
+	if client.err != ErrNoCommonProtocol || server.err == nil {
+		t.Errorf("RunClient() = %v, RunServer() = %v; want %v, error", client.err, server.err, ErrNoCommonProtocol)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", nil)
+
+	if err != nil {
+		t.Skip(err)
+	}
+
+	defer l.Close()
+
+	router := NewRouter()
+
+	for _, protocol := range []string{"upper", "lower"} {
+		protocol := protocol
+
+		router.Handle(protocol, func(c *Conn) {
+			c.Write([]byte(protocol))
+		})
+	}
+
+	go router.Serve(l)
+
+	for _, protocol := range []string{"lower", "upper"} {
+		c, err := Dial("tcp", l.Addr().String(), &Config{Protocols: []string{protocol}})
+
+		if err != nil {
+			t.Fatalf("Dial() = %v; want nil", err)
+		}
+
+		buf := make([]byte, 16)
+		n, err := c.Read(buf)
+
+		if err != nil || string(buf[:n]) != protocol {
+			t.Errorf("Read() = %q, %v; want %q, nil", buf[:n], err, protocol)
+		}
+
+		c.Close()
+	}
+}
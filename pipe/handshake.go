@@ -0,0 +1,88 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "errors"
+
+var (
+	ErrOutOfOrder = errors.New("noise/pipe: handshake step called out of order")
+	ErrTerminated = errors.New("noise/pipe: handshake has been terminated")
+
+	ErrEarlyRejected = errors.New("noise/pipe: early handshake wasn't for this server's key")
+	ErrBadEphemeral  = errors.New("noise/pipe: ephemeral key has the wrong length")
+)
+
+// Handshake is the behavior common to both sides of a handshake, so
+// that either can be driven or inspected generically.
+type Handshake interface {
+	State() State
+	Done() bool
+	PeerPublicKey() ciphersuite.PublicKey
+	Session(transport MessageTransport) (*Session, error)
+	Terminate()
+}
+
+var (
+	_ Handshake = (*ClientHandshake)(nil)
+	_ Handshake = (*ServerHandshake)(nil)
+)
+
+// A PeerVerifier decides whether to trust the peer's static key once
+// it has been authenticated. Returning an error aborts the handshake.
+type PeerVerifier func(peerKey ciphersuite.PublicKey) error
+
+// State is the step a handshake is waiting to perform next. Each side
+// of a handshake steps through Eph, Syn and Ack in that order.
+type State int
+
+const (
+	StateEph State = iota
+	StateSyn
+	StateAck
+	StateDone
+	StateFailed
+	StateTerminated
+)
+
+func (s State) String() string {
+	switch s {
+	case StateEph:
+		return "eph"
+	case StateSyn:
+		return "syn"
+	case StateAck:
+		return "ack"
+	case StateDone:
+		return "done"
+	case StateFailed:
+		return "failed"
+	case StateTerminated:
+		return "terminated"
+	}
+
+	return "unknown"
+}
+
+type handshakeState struct {
+	state State
+}
+
+func (h *handshakeState) State() State {
+	return h.state
+}
+
+func (h *handshakeState) Done() bool {
+	return h.state == StateDone
+}
+
+// Checks that the handshake is ready to perform the given step.
+func (h *handshakeState) expect(step State) error {
+	switch {
+	case h.state == StateFailed || h.state == StateTerminated:
+		return ErrTerminated
+	case h.state != step:
+		return ErrOutOfOrder
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package pipe
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stouset/go.noise/box"
+	"github.com/stouset/go.noise/ciphersuite"
+)
+
+var suite = ciphersuite.Noise255
+
+func TestHandshake(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+		client    = NewClientHandshake(suite, &clientKey)
+		server    = NewServerHandshake(suite, &serverKey)
+	)
+
+	eph, _ := client.Eph()
+	server.Eph(eph)
+
+	syn, _ := server.Syn([]byte("syn"), 0)
+	data, err := client.Syn(syn)
+
+	if err != nil || !bytes.Equal(data, []byte("syn")) {
+		t.Fatalf("client.Syn(syn) = %q, %v; want \"syn\", nil", data, err)
+	}
+
+	ack, _ := client.Ack([]byte("ack"), 0)
+	data, err = server.Ack(ack)
+
+	if err != nil || !bytes.Equal(data, []byte("ack")) {
+		t.Fatalf("server.Ack(ack) = %q, %v; want \"ack\", nil", data, err)
+	}
+
+	if !client.Done() || !server.Done() {
+		t.Errorf("Done() = %v, %v; want true, true", client.Done(), server.Done())
+	}
+}
+
+func TestHandshakeEarlyKeyring(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		keyring   = box.Keyring{}
+		client    = NewClientHandshake(suite, &clientKey)
+		server    = NewServerHandshake(suite, nil)
+	)
+
+	for i := 0; i < 3; i++ {
+		key := suite.NewKeypair()
+		keyring = append(keyring, &key)
+	}
+
+	server.SetKeyring(keyring)
+
+	eph, _ := client.EarlyEph(keyring[2].Public, []byte("early"), 0)
+	data, err := server.EarlyEph(eph)
+
+	if err != nil || !bytes.Equal(data, []byte("early")) {
+		t.Fatalf("server.EarlyEph(eph) = %q, %v; want \"early\", nil", data, err)
+	}
+
+	if index := server.KeyIndex(); index != 2 {
+		t.Errorf("KeyIndex() = %d; want 2", index)
+	}
+
+	syn, _ := server.Syn(nil, 0)
+
+	if _, err = client.Syn(syn); err != nil {
+		t.Errorf("client.Syn(syn) = %v; want nil", err)
+	}
+}
+
+func TestHandshakeOutOfOrder(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		client    = NewClientHandshake(suite, &clientKey)
+	)
+
+	if _, err := client.Ack(nil, 0); err != ErrOutOfOrder {
+		t.Errorf("Ack() before Eph() = %v; want %v", err, ErrOutOfOrder)
+	}
+
+	client.Eph()
+
+	if _, err := client.Eph(); err != ErrOutOfOrder {
+		t.Errorf("Eph() twice = %v; want %v", err, ErrOutOfOrder)
+	}
+}
+
+func TestHandshakeBadEphemeral(t *testing.T) {
+	for _, eph := range [][]byte{nil, make([]byte, suite.DHLen()-1), make([]byte, suite.DHLen()+1)} {
+		server := NewServerHandshake(suite, nil)
+
+		if err := server.Eph(eph); err != ErrBadEphemeral {
+			t.Errorf("Eph(%d bytes) = %v; want %v", len(eph), err, ErrBadEphemeral)
+		}
+
+		if server.State() != StateFailed {
+			t.Errorf("State() = %v; want %v", server.State(), StateFailed)
+		}
+	}
+}
+
+func TestHandshakeFailureTerminates(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		client    = NewClientHandshake(suite, &clientKey)
+	)
+
+	client.Eph()
+
+	if _, err := client.Syn(make([]byte, 128)); err == nil {
+		t.Fatal("Syn(garbage) = nil; want error")
+	}
+
+	if client.State() != StateFailed {
+		t.Errorf("State() = %v; want %v", client.State(), StateFailed)
+	}
+
+	if _, err := client.Ack(nil, 0); err != ErrTerminated {
+		t.Errorf("Ack() after failure = %v; want %v", err, ErrTerminated)
+	}
+}
+
+func TestHandshakePinnedKeyMismatch(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+		client    = NewClientHandshake(suite, &clientKey)
+		server    = NewServerHandshake(suite, &serverKey)
+	)
+
+	client.SetPeerVerifier(PinKeys(suite.NewKeypair().Public))
+
+	eph, _ := client.Eph()
+	server.Eph(eph)
+
+	syn, _ := server.Syn(nil, 0)
+
+	if _, err := client.Syn(syn); err != ErrKeyNotPinned {
+		t.Fatalf("client.Syn(syn) = %v; want %v", err, ErrKeyNotPinned)
+	}
+
+	if _, err := client.Ack(nil, 0); err != ErrTerminated {
+		t.Errorf("client.Ack() = %v; want %v", err, ErrTerminated)
+	}
+}
+
+func TestHandshakePaddingTooLongFails(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+		padLen    = uint32(1 << 31)
+	)
+
+	client := NewClientHandshake(suite, &clientKey)
+
+	if _, err := client.EarlyEph(serverKey.Public, nil, padLen); err == nil || client.State() != StateFailed {
+		t.Errorf("client.EarlyEph(padLen = %d) = %v, %v; want error, %v", padLen, err, client.State(), StateFailed)
+	}
+
+	client = NewClientHandshake(suite, &clientKey)
+	server := NewServerHandshake(suite, &serverKey)
+
+	eph, _ := client.Eph()
+	server.Eph(eph)
+
+	if _, err := server.Syn(nil, padLen); err == nil || server.State() != StateFailed {
+		t.Errorf("server.Syn(padLen = %d) = %v, %v; want error, %v", padLen, err, server.State(), StateFailed)
+	}
+
+	server = NewServerHandshake(suite, &serverKey)
+	server.Eph(eph)
+
+	syn, _ := server.Syn(nil, 0)
+	client.Syn(syn)
+
+	if _, err := client.Ack(nil, padLen); err == nil || client.State() != StateFailed {
+		t.Errorf("client.Ack(padLen = %d) = %v, %v; want error, %v", padLen, err, client.State(), StateFailed)
+	}
+
+	client = NewClientHandshake(suite, &clientKey)
+	server = NewServerHandshake(suite, nil)
+	server.SetKeyring(box.Keyring{&serverKey})
+
+	eph, _ = client.EarlyEph(serverKey.Public, nil, 0)
+	server.EarlyEph(eph)
+
+	if _, err := server.Syn(nil, padLen); err == nil || server.State() != StateFailed {
+		t.Errorf("server.Syn(early, padLen = %d) = %v, %v; want error, %v", padLen, err, server.State(), StateFailed)
+	}
+}
@@ -0,0 +1,177 @@
+package pipe
+
+import "errors"
+import "io"
+import "sync"
+import "time"
+
+var (
+	ErrIdleTimeout      = errors.New("noise/pipe: session was idle for too long")
+	ErrNotInterruptible = errors.New("noise/pipe: transport can't interrupt a blocked read")
+)
+
+// SessionStats describes a session's traffic, counting every record
+// sent and received including keepalives and key updates.
+type SessionStats struct {
+	MessagesSent     uint64
+	MessagesReceived uint64
+	BytesSent        uint64
+	BytesReceived    uint64
+
+	Established  time.Time
+	LastSent     time.Time
+	LastReceived time.Time
+}
+
+type sessionStats struct {
+	mu sync.Mutex
+	SessionStats
+}
+
+// Stats returns a snapshot of the session's traffic so far.
+func (s *Session) Stats() SessionStats {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+
+	return s.stats.SessionStats
+}
+
+// SetKeepalive makes the session send an empty record whenever nothing
+// else has been sent for interval, so that middleboxes don't forget the
+// connection. If a read has waited idleTimeout without receiving
+// anything, the session is terminated. Either may be zero to disable
+// it.
+//
+// Records are only seen as they're read, so a session that nothing is
+// reading from never idles out, however long its peer has been quiet.
+// The blocked read is interrupted by the transport's deadline, or by
+// closing it, so an idle timeout fails with ErrNotInterruptible on a
+// transport that supports neither.
+func (s *Session) SetKeepalive(interval time.Duration, idleTimeout time.Duration) error {
+	if idleTimeout > 0 && interrupter(s.transport) == nil {
+		return ErrNotInterruptible
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if s.stopKeepalive != nil {
+		close(s.stopKeepalive)
+		s.stopKeepalive = nil
+	}
+
+	tick := interval
+
+	if tick == 0 || (idleTimeout > 0 && idleTimeout < tick) {
+		tick = idleTimeout
+	}
+
+	if tick == 0 || s.sendCC == nil {
+		return nil
+	}
+
+	s.stopKeepalive = make(chan struct{})
+
+	go s.keepalive(s.stopKeepalive, tick, interval, idleTimeout)
+
+	return nil
+}
+
+func (s *Session) keepalive(
+	stop <-chan struct{},
+	tick time.Duration,
+	interval time.Duration,
+	idleTimeout time.Duration,
+) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			stats := s.Stats()
+
+			if idleTimeout > 0 && s.waited(now) >= idleTimeout {
+				s.idleOut()
+				return
+			}
+
+			if interval > 0 && now.Sub(latest(stats.LastSent, stats.Established)) >= interval {
+				s.writeRecord(recordKeepalive, nil)
+			}
+		}
+	}
+}
+
+// How long the pending read has been waiting for a record, or zero if
+// there is none.
+func (s *Session) waited(now time.Time) time.Duration {
+	since := s.readSince.Load()
+
+	if since == 0 {
+		return 0
+	}
+
+	return now.Sub(time.Unix(0, since))
+}
+
+// Terminates an idle session, first interrupting the read blocked on
+// the transport so that its lock is released.
+func (s *Session) idleOut() {
+	s.idle.Store(true)
+	interrupter(s.transport)()
+	s.Terminate()
+}
+
+// Returns a function that interrupts a read blocked on transport, or
+// nil if there's no way to.
+func interrupter(transport MessageTransport) func() {
+	// a stream transport only has a deadline if its stream does
+	if t, ok := transport.(*streamTransport); ok {
+		if _, ok := t.rw.(deadliner); !ok {
+			transport = nil
+
+			if c, ok := t.rw.(io.Closer); ok {
+				return func() { c.Close() }
+			}
+		}
+	}
+
+	if d, ok := transport.(deadliner); ok {
+		return func() { d.SetDeadline(time.Unix(1, 0)) }
+	}
+
+	if c, ok := transport.(io.Closer); ok {
+		return func() { c.Close() }
+	}
+
+	return nil
+}
+
+func (st *sessionStats) sent(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.MessagesSent++
+	st.BytesSent += uint64(n)
+	st.LastSent = time.Now()
+}
+
+func (st *sessionStats) received(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.MessagesReceived++
+	st.BytesReceived += uint64(n)
+	st.LastReceived = time.Now()
+}
+
+func latest(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,123 @@
+package pipe
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A chanTransport whose blocked reads are interrupted once it's closed.
+type closableTransport struct {
+	*chanTransport
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (t *closableTransport) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-t.in:
+		return msg, nil
+	case <-t.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+func (t *closableTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+// Returns sessions whose client side can be interrupted.
+func closablePair() (client *Session, server *Session) {
+	var (
+		cv = suite.NewChain()
+
+		toClient = make(chan []byte, 64)
+		toServer = make(chan []byte, 64)
+
+		transport = &closableTransport{
+			chanTransport: &chanTransport{in: toClient, out: toServer},
+			closed:        make(chan struct{}),
+		}
+	)
+
+	client = newSession(suite, transport, cv, true)
+	server = newSession(suite, &chanTransport{in: toServer, out: toClient}, cv, false)
+
+	return
+}
+
+func TestSessionKeepalive(t *testing.T) {
+	client, server := sessionPair()
+	defer client.Terminate()
+
+	client.SetKeepalive(time.Millisecond, 0)
+
+	// keepalives aren't returned by ReadMessage, but are counted
+	go server.ReadMessage()
+
+	deadline := time.Now().Add(time.Second)
+
+	for server.Stats().MessagesReceived == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no keepalive received")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if stats := client.Stats(); stats.MessagesSent == 0 || stats.LastSent.IsZero() {
+		t.Errorf("Stats() = %+v; want keepalives sent", stats)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	client, _ := closablePair()
+
+	if err := client.SetKeepalive(0, time.Millisecond); err != nil {
+		t.Fatalf("SetKeepalive() = %v; want nil", err)
+	}
+
+	// the read holds the session's receive lock until it's interrupted
+	go client.ReadMessage()
+
+	deadline := time.Now().Add(time.Second)
+
+	for client.WriteMessage(nil) != ErrIdleTimeout {
+		if time.Now().After(deadline) {
+			t.Fatal("session wasn't terminated after idle timeout")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if client.sendCC != nil || client.recvCC != nil {
+		t.Error("cipher contexts weren't wiped after idle timeout")
+	}
+}
+
+func TestSessionIdleTimeoutWithoutReader(t *testing.T) {
+	client, server := closablePair()
+	defer client.Terminate()
+	defer server.Terminate()
+
+	server.SetKeepalive(10*time.Millisecond, 0)
+	client.SetKeepalive(0, 20*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := client.WriteMessage(nil); err != nil {
+		t.Errorf("WriteMessage() with no reader = %v; want nil", err)
+	}
+}
+
+func TestSessionIdleTimeoutNotInterruptible(t *testing.T) {
+	client, _ := sessionPair()
+	defer client.Terminate()
+
+	if err := client.SetKeepalive(0, time.Second); err != ErrNotInterruptible {
+		t.Errorf("SetKeepalive() = %v; want %v", err, ErrNotInterruptible)
+	}
+}
@@ -0,0 +1,189 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "bufio"
+import "crypto/sha256"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "os"
+import "strings"
+import "sync"
+import "unicode"
+
+var (
+	ErrUnknownHost     = errors.New("noise/pipe: host is not known")
+	ErrHostKeyChanged  = errors.New("noise/pipe: host key doesn't match known hosts")
+	ErrHostKeyRejected = errors.New("noise/pipe: host key was rejected")
+)
+
+// TrustMode determines how KnownHosts treats a host it has no key for.
+type TrustMode int
+
+const (
+	// TrustOnFirstUse records and accepts the first key seen for a host.
+	TrustOnFirstUse TrustMode = iota
+
+	// TrustStrict rejects any host not already recorded.
+	TrustStrict
+
+	// TrustAsk records and accepts the key only if Ask approves it.
+	TrustAsk
+)
+
+// KnownHosts is a store of trusted server keys, kept in a text file.
+// Each line of the file holds a host name and the fingerprint of its
+// key, separated by whitespace. Blank lines and lines beginning with
+// '#' are ignored.
+type KnownHosts struct {
+	mu sync.Mutex
+
+	path  string
+	mode  TrustMode
+	hosts map[string]string
+
+	// Ask is consulted in TrustAsk mode to decide whether to trust an
+	// unknown host.
+	Ask func(host string, fingerprint string) bool
+}
+
+// LoadKnownHosts reads a known hosts file, which needn't exist yet.
+func LoadKnownHosts(
+	path string,
+	mode TrustMode,
+) (
+	k *KnownHosts,
+	err error,
+) {
+	k = &KnownHosts{
+		path:  path,
+		mode:  mode,
+		hosts: make(map[string]string),
+	}
+
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("noise/pipe: %s:%d: malformed known host", path, n)
+		}
+
+		k.hosts[fields[0]] = fields[1]
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Fingerprint returns a printable digest of a public key.
+func Fingerprint(key ciphersuite.PublicKey) string {
+	sum := sha256.Sum256(key)
+
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Verify checks key against the one known for host, deciding whether
+// to trust it according to the store's mode if host is unknown.
+func (k *KnownHosts) Verify(host string, key ciphersuite.PublicKey) error {
+	fingerprint := Fingerprint(key)
+
+	k.mu.Lock()
+	known, err := k.lookup(host, fingerprint)
+	k.mu.Unlock()
+
+	if known {
+		return err
+	}
+
+	switch k.mode {
+	case TrustStrict:
+		return ErrUnknownHost
+	case TrustAsk:
+		// Ask may wait on the user, so it's called without the lock,
+		// and the host is looked up again in case it was recorded
+		// meanwhile
+		if k.Ask == nil || !k.Ask(host, fingerprint) {
+			return ErrHostKeyRejected
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if known, err = k.lookup(host, fingerprint); known {
+		return err
+	}
+
+	return k.add(host, fingerprint)
+}
+
+// Verifier returns a PeerVerifier that checks the server's key against
+// the one known for host.
+func (k *KnownHosts) Verifier(host string) PeerVerifier {
+	return func(key ciphersuite.PublicKey) error {
+		return k.Verify(host, key)
+	}
+}
+
+// Reports whether host is known, and if so whether fingerprint is its
+// key.
+func (k *KnownHosts) lookup(host string, fingerprint string) (known bool, err error) {
+	recorded, known := k.hosts[host]
+
+	if known && recorded != fingerprint {
+		err = ErrHostKeyChanged
+	}
+
+	return known, err
+}
+
+func (k *KnownHosts) add(host string, fingerprint string) error {
+	// the file is split into fields by strings.Fields, so the name
+	// mustn't be empty or contain anything it treats as a space
+	if host == "" || strings.IndexFunc(host, unicode.IsSpace) >= 0 || strings.HasPrefix(host, "#") {
+		return fmt.Errorf("noise/pipe: can't record host name %q", host)
+	}
+
+	file, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintf(file, "%s %s\n", host, fingerprint); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	k.hosts[host] = fingerprint
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package pipe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownHostsTrustOnFirstUse(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "known_hosts")
+		key  = suite.NewKeypair().Public
+	)
+
+	hosts, err := LoadKnownHosts(path, TrustOnFirstUse)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = hosts.Verify("example", key); err != nil {
+		t.Errorf("Verify(unknown) = %v; want nil", err)
+	}
+
+	hosts, err = LoadKnownHosts(path, TrustStrict)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = hosts.Verify("example", key); err != nil {
+		t.Errorf("Verify(known) = %v; want nil", err)
+	}
+
+	if err = hosts.Verify("example", suite.NewKeypair().Public); err != ErrHostKeyChanged {
+		t.Errorf("Verify(changed) = %v; want %v", err, ErrHostKeyChanged)
+	}
+
+	if err = hosts.Verify("other", key); err != ErrUnknownHost {
+		t.Errorf("Verify(unknown) = %v; want %v", err, ErrUnknownHost)
+	}
+}
+
+func TestKnownHostsAsk(t *testing.T) {
+	hosts, err := LoadKnownHosts(filepath.Join(t.TempDir(), "known_hosts"), TrustAsk)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts.Ask = func(host string, fingerprint string) bool { return false }
+
+	if err = hosts.Verify("example", suite.NewKeypair().Public); err != ErrHostKeyRejected {
+		t.Errorf("Verify(rejected) = %v; want %v", err, ErrHostKeyRejected)
+	}
+}
+
+func TestKnownHostsAskUnlocked(t *testing.T) {
+	var (
+		path     = filepath.Join(t.TempDir(), "known_hosts")
+		knownKey = suite.NewKeypair().Public
+	)
+
+	os.WriteFile(path, []byte("known "+Fingerprint(knownKey)+"\n"), 0600)
+
+	hosts, err := LoadKnownHosts(path, TrustAsk)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts.Ask = func(host string, fingerprint string) bool {
+		return hosts.Verify("known", knownKey) == nil
+	}
+
+	if err = hosts.Verify("example", suite.NewKeypair().Public); err != nil {
+		t.Errorf("Verify(approved) = %v; want nil", err)
+	}
+}
+
+func TestKnownHostsUnrecordableName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+
+	hosts, err := LoadKnownHosts(path, TrustOnFirstUse)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"", "exa\u00a0mple", "exa\vmple", "exa mple", "#example"} {
+		if err = hosts.Verify(host, suite.NewKeypair().Public); err == nil {
+			t.Errorf("Verify(%q) = nil; want error", host)
+		}
+	}
+
+	if err = hosts.Verify("example", suite.NewKeypair().Public); err != nil {
+		t.Fatalf("Verify(example) = %v; want nil", err)
+	}
+
+	if _, err = LoadKnownHosts(path, TrustStrict); err != nil {
+		t.Errorf("LoadKnownHosts() = %v; want nil", err)
+	}
+}
@@ -0,0 +1,54 @@
+package pipe
+
+import "net"
+
+// A Listener accepts connections and performs the server side of a
+// handshake over each of them.
+type Listener struct {
+	net.Listener
+
+	config *Config
+}
+
+// Listen announces on address, performing handshakes as configured by
+// config.
+func Listen(
+	network string,
+	address string,
+	config *Config,
+) (
+	l *Listener,
+	err error,
+) {
+	listener, err := net.Listen(network, address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewListener(listener, config), nil
+}
+
+func NewListener(listener net.Listener, config *Config) (l *Listener) {
+	return &Listener{Listener: listener, config: config}
+}
+
+// Accept waits for a connection and returns it. Its handshake is
+// performed on its first Read or Write, or when Handshake is called, so
+// that a slow client doesn't hold up the connections accepted after
+// it. A handshake that fails is returned from that call, rather than
+// from Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptPipe()
+}
+
+// AcceptPipe is like Accept, but returns a *Conn.
+func (l *Listener) AcceptPipe() (c *Conn, err error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newServerConn(conn, l.config), nil
+}
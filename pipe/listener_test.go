@@ -0,0 +1,103 @@
+package pipe
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestListenerSlowClient(t *testing.T) {
+	serverKey := suite.NewKeypair()
+
+	l, err := Listen("tcp", "127.0.0.1:0", &Config{Keypair: &serverKey})
+
+	if err != nil {
+		t.Skip(err)
+	}
+
+	defer l.Close()
+
+	// a client that connects but never starts its handshake
+	silent, err := net.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+
+	stalled, err := l.AcceptPipe()
+
+	if err != nil {
+		t.Fatalf("AcceptPipe(silent client) = %v; want nil", err)
+	}
+
+	defer stalled.Close()
+
+	done := make(chan error)
+
+	go func() {
+		c, err := Dial("tcp", l.Addr().String(), nil)
+
+		if err == nil {
+			_, err = c.Write([]byte("ping"))
+			c.Close()
+		}
+
+		done <- err
+	}()
+
+	c, err := l.AcceptPipe()
+
+	if err != nil {
+		t.Fatalf("AcceptPipe() = %v; want nil", err)
+	}
+
+	defer c.Close()
+
+	buf := make([]byte, 4)
+	n, err := c.Read(buf)
+
+	if err != nil || !bytes.Equal(buf[:n], []byte("ping")) {
+		t.Errorf("Read() = %q, %v; want \"ping\", nil", buf[:n], err)
+	}
+
+	if err = <-done; err != nil {
+		t.Errorf("Dial() = %v; want nil", err)
+	}
+}
+
+func TestListenerFailedHandshake(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", nil)
+
+	if err != nil {
+		t.Skip(err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+
+		if err == nil {
+			conn.Write([]byte("\x04\x00\x00\x00junk"))
+			conn.Close()
+		}
+	}()
+
+	c, err := l.Accept()
+
+	if err != nil {
+		t.Fatalf("Accept() = %v; want nil", err)
+	}
+
+	defer c.Close()
+
+	if _, err = c.Read(make([]byte, 1)); err == nil {
+		t.Error("Read() after failed handshake = nil; want error")
+	}
+
+	if err = c.(*Conn).Handshake(); err == nil {
+		t.Error("Handshake() after failed handshake = nil; want error")
+	}
+}
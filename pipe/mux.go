@@ -0,0 +1,649 @@
+package pipe
+
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "os"
+import "sync"
+import "time"
+
+// Each message on a multiplexed session is a frame, starting with its
+// type and the 4-byte little-endian ID of the stream it belongs to.
+const (
+	frameOpen   = 0
+	frameData   = 1
+	frameWindow = 2
+	frameClose  = 3
+	frameReset  = 4
+
+	frameHeaderLen = 5
+)
+
+// How much data either side of a stream may send before the other has
+// read it.
+const streamWindow = 1 << 18
+
+// How many opened streams may wait to be accepted before more are
+// refused.
+const acceptBacklog = 64
+
+var (
+	ErrMuxClosed     = errors.New("noise/pipe: multiplexer is closed")
+	ErrStreamClosed  = errors.New("noise/pipe: stream is closed")
+	ErrStreamReset   = errors.New("noise/pipe: stream was reset by the peer")
+	ErrFlowControl   = errors.New("noise/pipe: peer exceeded the stream's window")
+	ErrUnknownFrame  = errors.New("noise/pipe: unknown frame type")
+	ErrInvalidStream = errors.New("noise/pipe: peer opened an invalid stream")
+	ErrResetBacklog  = errors.New("noise/pipe: peer isn't reading the streams it's refused")
+)
+
+// A Mux carries many independent streams over a single session, so
+// that each doesn't need its own handshake. Either side may open
+// streams, which the other accepts. Once a session is multiplexed it
+// mustn't be read from or written to other than by the Mux.
+type Mux struct {
+	session *Session
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	// the highest ID of a stream the peer has opened, since IDs are
+	// never reused
+	peerID uint32
+
+	accept chan *Stream
+	done   chan struct{}
+
+	// streams to reset, which are written by resetLoop so that the
+	// read loop never waits on the peer reading
+	resets chan uint32
+}
+
+// A Stream is one of the streams carried by a Mux. It is a net.Conn.
+type Stream struct {
+	mux *Mux
+	id  uint32
+
+	mu   sync.Mutex
+	cond sync.Cond
+
+	recvBuf    []byte
+	recvWindow uint32
+	consumed   uint32
+	sendWindow uint32
+
+	// whether the peer has closed its side, and whether we have closed
+	// ours for writing or entirely
+	readClosed  bool
+	writeClosed bool
+	closed      bool
+
+	err error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+type streamAddr uint32
+
+// NewMux begins multiplexing streams over session, reading from it
+// until it fails or is closed.
+func NewMux(session *Session) *Mux {
+	m := &Mux{
+		session: session,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+		resets:  make(chan uint32, acceptBacklog),
+	}
+
+	// clients open odd-numbered streams, and servers even-numbered ones
+	if session.client {
+		m.nextID = 1
+	}
+
+	go m.readLoop()
+	go m.resetLoop()
+
+	return m
+}
+
+// Open opens a new stream to the peer.
+func (m *Mux) Open() (*Stream, error) {
+	m.mu.Lock()
+
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+
+	st := m.newStream(m.nextID)
+	m.nextID += 2
+
+	m.mu.Unlock()
+
+	if err := m.writeFrame(frameOpen, st.id, nil); err != nil {
+		m.remove(st.id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (m *Mux) Accept() (*Stream, error) {
+	select {
+	case st := <-m.accept:
+		return st, nil
+	case <-m.done:
+		return nil, m.err
+	}
+}
+
+// Close fails every stream and tells the peer nothing more will be
+// sent. The underlying connection should be closed afterward, to stop
+// the Mux reading from it.
+func (m *Mux) Close() error {
+	m.fail(ErrMuxClosed)
+
+	return m.session.CloseWrite()
+}
+
+// Creates and tracks a stream. The caller must hold mu.
+func (m *Mux) newStream(id uint32) *Stream {
+	st := &Stream{
+		mux:        m,
+		id:         id,
+		recvWindow: streamWindow,
+		sendWindow: streamWindow,
+	}
+
+	st.cond.L = &st.mu
+	m.streams[id] = st
+
+	return st
+}
+
+func (m *Mux) stream(id uint32) *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.streams[id]
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.streams, id)
+}
+
+func (m *Mux) readLoop() {
+	for {
+		msg, err := m.session.ReadMessage()
+
+		if err == nil && len(msg) < frameHeaderLen {
+			err = ErrShortMessage
+		}
+
+		if err == nil {
+			err = m.receive(msg[0], binary.LittleEndian.Uint32(msg[1:]), msg[frameHeaderLen:])
+		}
+
+		if err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *Mux) receive(frameType byte, id uint32, payload []byte) error {
+	if frameType == frameOpen {
+		return m.receiveOpen(id)
+	}
+
+	st := m.stream(id)
+
+	// frames may still arrive for streams we've reset
+	if st == nil {
+		return nil
+	}
+
+	switch frameType {
+	case frameData:
+		return st.receiveData(payload)
+	case frameWindow:
+		if len(payload) != 4 {
+			return ErrShortMessage
+		}
+
+		return st.receiveWindow(binary.LittleEndian.Uint32(payload))
+	case frameClose:
+		st.receiveClose()
+	case frameReset:
+		st.fail(ErrStreamReset)
+		m.remove(id)
+	default:
+		return ErrUnknownFrame
+	}
+
+	return nil
+}
+
+func (m *Mux) receiveOpen(id uint32) error {
+	m.mu.Lock()
+
+	if id%2 == m.nextID%2 || id <= m.peerID {
+		m.mu.Unlock()
+		return ErrInvalidStream
+	}
+
+	m.peerID = id
+	st := m.newStream(id)
+
+	m.mu.Unlock()
+
+	select {
+	case m.accept <- st:
+		return nil
+	default:
+		m.remove(id)
+		return m.reset(id)
+	}
+}
+
+// Queues a reset of the stream id for resetLoop to send. If the peer
+// stops reading, so that resets pile up, the Mux fails rather than
+// queueing them without bound.
+func (m *Mux) reset(id uint32) error {
+	select {
+	case m.resets <- id:
+		return nil
+	default:
+		return ErrResetBacklog
+	}
+}
+
+func (m *Mux) resetLoop() {
+	for {
+		select {
+		case id := <-m.resets:
+			m.writeFrame(frameReset, id, nil)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Fails the Mux and every stream on it with err.
+func (m *Mux) fail(err error) {
+	m.mu.Lock()
+
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+
+	streams := m.streams
+
+	m.err = err
+	m.streams = make(map[uint32]*Stream)
+	close(m.done)
+
+	m.mu.Unlock()
+
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+func (m *Mux) writeFrame(frameType byte, id uint32, payload []byte) error {
+	frame := make([]byte, frameHeaderLen+len(payload))
+	frame[0] = frameType
+	binary.LittleEndian.PutUint32(frame[1:], id)
+	copy(frame[frameHeaderLen:], payload)
+
+	return m.session.WriteMessage(frame)
+}
+
+func (m *Mux) writeWindow(id uint32, increment uint32) error {
+	var payload [4]byte
+	binary.LittleEndian.PutUint32(payload[:], increment)
+
+	return m.writeFrame(frameWindow, id, payload[:])
+}
+
+// The most data that fits in a single frame.
+func (m *Mux) maxDataLen() int {
+	return m.session.maxDataLen() - frameHeaderLen
+}
+
+// ID returns the stream's ID, which is unique for the lifetime of its
+// Mux.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	st.mu.Lock()
+
+	for len(st.recvBuf) == 0 {
+		switch {
+		case st.closed:
+			err = ErrStreamClosed
+		case st.err != nil:
+			err = st.err
+		case st.readClosed:
+			err = io.EOF
+		case passed(st.readDeadline):
+			err = os.ErrDeadlineExceeded
+		}
+
+		if err != nil {
+			st.mu.Unlock()
+			return 0, err
+		}
+
+		st.cond.Wait()
+	}
+
+	n = copy(b, st.recvBuf)
+	st.recvBuf = st.recvBuf[n:]
+	st.consumed += uint32(n)
+
+	// let the peer send more once half the window has been read
+	var increment uint32
+
+	if st.consumed >= streamWindow/2 && !st.readClosed {
+		increment, st.consumed = st.consumed, 0
+		st.recvWindow += increment
+	}
+
+	st.mu.Unlock()
+
+	if increment > 0 {
+		st.mux.writeWindow(st.id, increment)
+	}
+
+	return n, nil
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	maxLen := st.mux.maxDataLen()
+
+	for len(b) > 0 {
+		st.mu.Lock()
+
+		for st.sendWindow == 0 && !st.closed && !st.writeClosed && st.err == nil && !passed(st.writeDeadline) {
+			st.cond.Wait()
+		}
+
+		switch {
+		case st.closed || st.writeClosed:
+			err = ErrStreamClosed
+		case st.err != nil:
+			err = st.err
+		case st.sendWindow == 0:
+			err = os.ErrDeadlineExceeded
+		}
+
+		if err != nil {
+			st.mu.Unlock()
+			return n, err
+		}
+
+		chunk := b
+
+		if len(chunk) > maxLen {
+			chunk = chunk[:maxLen]
+		}
+
+		if uint32(len(chunk)) > st.sendWindow {
+			chunk = chunk[:st.sendWindow]
+		}
+
+		st.sendWindow -= uint32(len(chunk))
+		st.mu.Unlock()
+
+		if err = st.mux.writeFrame(frameData, st.id, chunk); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// CloseWrite tells the peer that nothing more will be written, after
+// which its reads return io.EOF. The stream can still be read from.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+
+	if st.closed || st.writeClosed || st.err != nil {
+		st.mu.Unlock()
+		return ErrStreamClosed
+	}
+
+	st.writeClosed = true
+	st.cond.Broadcast()
+
+	done := st.readClosed
+
+	st.mu.Unlock()
+
+	if done {
+		st.mux.remove(st.id)
+	}
+
+	return st.mux.writeFrame(frameClose, st.id, nil)
+}
+
+// Close closes the stream for both reading and writing. Any data the
+// peer sends afterward is refused by resetting the stream.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+
+	if st.closed {
+		st.mu.Unlock()
+		return ErrStreamClosed
+	}
+
+	var (
+		sendClose = !st.writeClosed && st.err == nil
+		done      = st.readClosed || st.err != nil
+	)
+
+	st.closed = true
+	st.recvBuf = nil
+	st.cond.Broadcast()
+	st.stopTimers()
+
+	st.mu.Unlock()
+
+	if done {
+		st.mux.remove(st.id)
+	}
+
+	if sendClose {
+		return st.mux.writeFrame(frameClose, st.id, nil)
+	}
+
+	return nil
+}
+
+// Reset abruptly closes the stream in both directions, discarding any
+// data not yet read by either side.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+
+	if st.err != nil {
+		st.mu.Unlock()
+		return ErrStreamClosed
+	}
+
+	st.closed = true
+	st.err = ErrStreamClosed
+	st.recvBuf = nil
+	st.cond.Broadcast()
+	st.stopTimers()
+
+	st.mu.Unlock()
+
+	st.mux.remove(st.id)
+
+	return st.mux.writeFrame(frameReset, st.id, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return streamAddr(st.id) }
+func (st *Stream) RemoteAddr() net.Addr { return streamAddr(st.id) }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.readDeadline = t
+	st.readTimer = st.resetTimer(st.readTimer, t)
+
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.writeDeadline = t
+	st.writeTimer = st.resetTimer(st.writeTimer, t)
+
+	return nil
+}
+
+// Wakes any blocked reads and writes when a deadline passes. The caller
+// must hold mu.
+func (st *Stream) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+
+	st.cond.Broadcast()
+
+	if t.IsZero() {
+		return nil
+	}
+
+	return time.AfterFunc(time.Until(t), func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		st.cond.Broadcast()
+	})
+}
+
+// The caller must hold mu.
+func (st *Stream) stopTimers() {
+	if st.readTimer != nil {
+		st.readTimer.Stop()
+	}
+
+	if st.writeTimer != nil {
+		st.writeTimer.Stop()
+	}
+}
+
+func (st *Stream) receiveData(payload []byte) error {
+	st.mu.Lock()
+
+	if st.closed || st.readClosed {
+		st.mu.Unlock()
+		st.mux.remove(st.id)
+
+		return st.mux.reset(st.id)
+	}
+
+	if uint32(len(payload)) > st.recvWindow {
+		st.mu.Unlock()
+
+		return st.failFlowControl()
+	}
+
+	st.recvWindow -= uint32(len(payload))
+	st.recvBuf = append(st.recvBuf, payload...)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	return nil
+}
+
+func (st *Stream) receiveWindow(increment uint32) error {
+	st.mu.Lock()
+
+	// the window can never legitimately exceed what fits in a uint32
+	if st.sendWindow+increment < st.sendWindow {
+		st.mu.Unlock()
+
+		return st.failFlowControl()
+	}
+
+	st.sendWindow += increment
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	return nil
+}
+
+// Fails and resets a stream whose peer has broken flow control.
+func (st *Stream) failFlowControl() error {
+	st.fail(ErrFlowControl)
+	st.mux.remove(st.id)
+
+	return st.mux.reset(st.id)
+}
+
+func (st *Stream) receiveClose() {
+	st.mu.Lock()
+
+	st.readClosed = true
+	st.cond.Broadcast()
+
+	done := st.closed || st.writeClosed
+
+	st.mu.Unlock()
+
+	if done {
+		st.mux.remove(st.id)
+	}
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.err == nil {
+		st.err = err
+	}
+
+	st.cond.Broadcast()
+	st.stopTimers()
+}
+
+func (a streamAddr) Network() string { return "pipe" }
+func (a streamAddr) String() string  { return fmt.Sprintf("stream %d", uint32(a)) }
+
+func passed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
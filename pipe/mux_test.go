@@ -0,0 +1,162 @@
+package pipe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func streamPair(t *testing.T) (client *Stream, server *Stream) {
+	clientSession, serverSession := sessionPair()
+
+	var (
+		clientMux = NewMux(clientSession)
+		serverMux = NewMux(serverSession)
+	)
+
+	client, err := clientMux.Open()
+
+	if err != nil {
+		t.Fatalf("Open() = %v; want nil", err)
+	}
+
+	if server, err = serverMux.Accept(); err != nil {
+		t.Fatalf("Accept() = %v; want nil", err)
+	}
+
+	if client.ID() != server.ID() {
+		t.Errorf("ID() = %d, %d; want equal", client.ID(), server.ID())
+	}
+
+	return
+}
+
+func TestMuxHalfClose(t *testing.T) {
+	var (
+		client, server = streamPair(t)
+
+		conn net.Conn = client
+	)
+
+	conn.Write([]byte("request"))
+	client.CloseWrite()
+
+	request, err := io.ReadAll(server)
+
+	if err != nil || !bytes.Equal(request, []byte("request")) {
+		t.Fatalf("ReadAll(server) = %q, %v; want \"request\", nil", request, err)
+	}
+
+	server.Write([]byte("response"))
+	server.Close()
+
+	response, err := io.ReadAll(conn)
+
+	if err != nil || !bytes.Equal(response, []byte("response")) {
+		t.Errorf("ReadAll(client) = %q, %v; want \"response\", nil", response, err)
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	var (
+		client, server = streamPair(t)
+
+		data = bytes.Repeat([]byte("data"), streamWindow)
+	)
+
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+
+	out, err := io.ReadAll(server)
+
+	if err != nil || !bytes.Equal(out, data) {
+		t.Errorf("ReadAll(server) = %d bytes, %v; want %d bytes, nil", len(out), err, len(data))
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	client, server := streamPair(t)
+
+	client.Reset()
+
+	if _, err := server.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("Read() after reset = %v; want %v", err, ErrStreamReset)
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, _ := streamPair(t)
+
+	client.SetReadDeadline(time.Now().Add(time.Millisecond))
+
+	if _, err := client.Read(make([]byte, 1)); err != os.ErrDeadlineExceeded {
+		t.Errorf("Read() after deadline = %v; want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestMuxReopenedStream(t *testing.T) {
+	client, server := streamPair(t)
+
+	client.Close()
+	client.mux.writeFrame(frameOpen, client.ID(), nil)
+
+	if _, err := server.mux.Accept(); err != ErrInvalidStream {
+		t.Errorf("Accept() after reopening stream %d = %v; want %v", client.ID(), err, ErrInvalidStream)
+	}
+}
+
+func TestMuxWindowOverflow(t *testing.T) {
+	client, server := streamPair(t)
+
+	client.mux.writeWindow(client.ID(), math.MaxUint32)
+
+	if _, err := client.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("Read() after window overflow = %v; want %v", err, ErrStreamReset)
+	}
+
+	if _, err := server.Write([]byte("data")); err != ErrFlowControl {
+		t.Errorf("Write() after window overflow = %v; want %v", err, ErrFlowControl)
+	}
+}
+
+func TestMuxRefusalsDontBlockReads(t *testing.T) {
+	var (
+		client, server = sessionPair()
+
+		mux   = NewMux(server)
+		frame = make([]byte, frameHeaderLen)
+	)
+
+	// the client never reads, so the resets refusing its streams back
+	// up once the backlog is full
+	go func() {
+		for id := uint32(1); ; id += 2 {
+			select {
+			case <-mux.done:
+				return
+			default:
+			}
+
+			frame[0] = frameOpen
+			binary.LittleEndian.PutUint32(frame[1:], id)
+			client.WriteMessage(frame)
+		}
+	}()
+
+	select {
+	case <-mux.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mux still reading after its refusals backed up; want failed")
+	}
+
+	if mux.err != ErrResetBacklog {
+		t.Errorf("Mux failed with %v; want %v", mux.err, ErrResetBacklog)
+	}
+}
@@ -0,0 +1,156 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "bytes"
+import "errors"
+import "strings"
+
+// Suites are named in an offer by their names, NUL-padded to a fixed
+// length.
+const suiteNameLen = 24
+
+// The service a client asks for is named in its offer in the same way,
+// so that its length isn't revealed.
+const serverNameLen = 64
+
+var (
+	ErrNoCommonSuite     = errors.New("noise/pipe: no ciphersuite in common with the peer")
+	ErrSuiteMismatch     = errors.New("noise/pipe: peer's ciphersuite doesn't match the one negotiated")
+	ErrTooManySuites     = errors.New("noise/pipe: too many ciphersuites to offer")
+	ErrServerNameTooLong = errors.New("noise/pipe: server name too long")
+)
+
+// A suiteOffer is an offer as parsed by the server.
+type suiteOffer struct {
+	raw        []byte
+	suites     []string
+	keyed      int
+	serverName string
+}
+
+// A client offers its suites by beginning a full handshake with the
+// number of suites it supports, their names in order of preference, the
+// index of the one its ephemeral key is for, and the name of the service
+// it wants to reach. The server answers with the Syn if it picks that
+// suite, or asks the client to retry with the one it does pick. Either
+// way, the offer that the Syn answers and the suite picked are bound
+// into the handshake, so that an attacker who strips suites from the
+// offer to force a weaker one, or changes the service asked for, only
+// causes the handshake to fail.
+func offerSuites(
+	suites []ciphersuite.Ciphersuite,
+	keyed ciphersuite.Ciphersuite,
+	serverName string,
+) (
+	offer []byte,
+	err error,
+) {
+	if len(suites) > 255 {
+		return nil, ErrTooManySuites
+	}
+
+	if len(serverName) > serverNameLen || strings.IndexByte(serverName, 0) >= 0 {
+		return nil, ErrServerNameTooLong
+	}
+
+	offer = make([]byte, 1+len(suites)*suiteNameLen+1+serverNameLen)
+	offer[0] = byte(len(suites))
+
+	for i, suite := range suites {
+		copy(offer[1+i*suiteNameLen:], suite.Name())
+
+		if suite == keyed {
+			offer[1+len(suites)*suiteNameLen] = byte(i)
+		}
+	}
+
+	copy(offer[len(offer)-serverNameLen:], serverName)
+
+	return offer, nil
+}
+
+// Splits an offer from the ephemeral key that follows it. If the server
+// knows the suite the key is for, the key must be the right length for
+// it.
+func (c *Config) parseOffer(msg []byte) (offer *suiteOffer, eph []byte, err error) {
+	if len(msg) == 0 {
+		return nil, nil, ErrShortMessage
+	}
+
+	var (
+		n        = int(msg[0])
+		offerLen = 1 + n*suiteNameLen + 1 + serverNameLen
+	)
+
+	if len(msg) < offerLen {
+		return nil, nil, ErrShortMessage
+	}
+
+	offer = &suiteOffer{
+		raw:    msg[:offerLen],
+		suites: make([]string, n),
+		keyed:  int(msg[1+n*suiteNameLen]),
+	}
+
+	for i := range offer.suites {
+		name := msg[1+i*suiteNameLen : 1+(i+1)*suiteNameLen]
+		offer.suites[i] = string(bytes.TrimRight(name, "\x00"))
+	}
+
+	if offer.keyed >= n {
+		return nil, nil, ErrUnexpectedMessage
+	}
+
+	offer.serverName = string(bytes.TrimRight(msg[offerLen-serverNameLen:offerLen], "\x00"))
+	eph = msg[offerLen:]
+
+	if keyed := c.findSuite([]byte(offer.suites[offer.keyed])); keyed != nil && len(eph) != keyed.DHLen() {
+		return nil, nil, ErrBadEphemeral
+	}
+
+	return offer, eph, nil
+}
+
+// Picks the server's most preferred suite among those offered.
+func (c *Config) selectSuite(names []string) ciphersuite.Ciphersuite {
+	for _, suite := range c.suites() {
+		for _, name := range names {
+			if suite.Name() == name {
+				return suite
+			}
+		}
+	}
+
+	return nil
+}
+
+// Finds an offered suite by name.
+func (c *Config) findSuite(name []byte) ciphersuite.Ciphersuite {
+	name = bytes.TrimRight(name, "\x00")
+
+	for _, suite := range c.suites() {
+		if suite.Name() == string(name) {
+			return suite
+		}
+	}
+
+	return nil
+}
+
+// The data bound into a handshake once a suite has been negotiated.
+func bindSuite(offer []byte, suite ciphersuite.Ciphersuite) []byte {
+	bound := make([]byte, len(offer)+suiteNameLen)
+
+	copy(bound, offer)
+	copy(bound[len(offer):], suite.Name())
+
+	return bound
+}
+
+func encodeSuiteName(suite ciphersuite.Ciphersuite) []byte {
+	name := make([]byte, suiteNameLen)
+	copy(name, suite.Name())
+
+	return name
+}
@@ -0,0 +1,239 @@
+package pipe
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stouset/go.noise/ciphersuite"
+)
+
+// A renamedSuite is Noise255 under another name, standing in for a
+// second suite.
+type renamedSuite struct {
+	ciphersuite.Ciphersuite
+	name string
+}
+
+func (s *renamedSuite) Name() string { return s.name }
+
+var strongSuite = &renamedSuite{ciphersuite.Noise255, "Strong"}
+
+func negotiatePair(
+	t *testing.T,
+	clientSuites []ciphersuite.Ciphersuite,
+	serverSuites []ciphersuite.Ciphersuite,
+	tamper func(msg []byte) []byte,
+) (
+	client runResult,
+	server runResult,
+) {
+	return handshakePair(t, &Config{Suites: clientSuites}, &Config{Suites: serverSuites}, tamper)
+}
+
+func TestNegotiateKeyedSuite(t *testing.T) {
+	client, server := negotiatePair(t,
+		[]ciphersuite.Ciphersuite{strongSuite, ciphersuite.Noise255},
+		[]ciphersuite.Ciphersuite{strongSuite, ciphersuite.Noise255},
+		nil,
+	)
+
+	if client.err != nil || server.err != nil {
+		t.Fatalf("RunClient() = %v, RunServer() = %v; want nil, nil", client.err, server.err)
+	}
+
+	if client.session.suite != strongSuite || server.session.suite != strongSuite {
+		t.Errorf("suites = %s, %s; want Strong", client.session.suite.Name(), server.session.suite.Name())
+	}
+}
+
+func TestNegotiateServerPreference(t *testing.T) {
+	client, server := negotiatePair(t,
+		[]ciphersuite.Ciphersuite{ciphersuite.Noise255, strongSuite},
+		[]ciphersuite.Ciphersuite{strongSuite, ciphersuite.Noise255},
+		nil,
+	)
+
+	if client.err != nil || server.err != nil {
+		t.Fatalf("RunClient() = %v, RunServer() = %v; want nil, nil", client.err, server.err)
+	}
+
+	if client.session.suite != strongSuite || server.session.suite != strongSuite {
+		t.Errorf("suites = %s, %s; want Strong", client.session.suite.Name(), server.session.suite.Name())
+	}
+}
+
+func TestNegotiateRetry(t *testing.T) {
+	client, server := negotiatePair(t,
+		[]ciphersuite.Ciphersuite{strongSuite, ciphersuite.Noise255},
+		[]ciphersuite.Ciphersuite{ciphersuite.Noise255},
+		nil,
+	)
+
+	if client.err != nil || server.err != nil {
+		t.Fatalf("RunClient() = %v, RunServer() = %v; want nil, nil", client.err, server.err)
+	}
+
+	if client.session.suite != ciphersuite.Noise255 || server.session.suite != ciphersuite.Noise255 {
+		t.Errorf("suites = %s, %s; want Noise255", client.session.suite.Name(), server.session.suite.Name())
+	}
+}
+
+func TestNegotiateNoCommonSuite(t *testing.T) {
+	client, server := negotiatePair(t,
+		[]ciphersuite.Ciphersuite{strongSuite},
+		[]ciphersuite.Ciphersuite{ciphersuite.Noise255},
+		nil,
+	)
+
+	if client.err != ErrNoCommonSuite || server.err != ErrNoCommonSuite {
+		t.Errorf("RunClient() = %v, RunServer() = %v; want %v", client.err, server.err, ErrNoCommonSuite)
+	}
+}
+
+func TestNegotiateDowngrade(t *testing.T) {
+	// strip the client's preferred suite from its offer, keying its
+	// ephemeral key for the weaker one instead
+	downgrade := func(msg []byte) []byte {
+		offer, _ := offerSuites([]ciphersuite.Ciphersuite{ciphersuite.Noise255}, ciphersuite.Noise255, "")
+		eph := msg[1+1+2*suiteNameLen+1+serverNameLen:]
+
+		return append(append([]byte{firstNegotiate}, offer...), eph...)
+	}
+
+	client, server := negotiatePair(t,
+		[]ciphersuite.Ciphersuite{strongSuite, ciphersuite.Noise255},
+		[]ciphersuite.Ciphersuite{strongSuite, ciphersuite.Noise255},
+		downgrade,
+	)
+
+	if client.err == nil || server.err == nil {
+		t.Errorf("RunClient() = %v, RunServer() = %v; want errors", client.err, server.err)
+	}
+}
+
+func TestParseOffer(t *testing.T) {
+	suites := []ciphersuite.Ciphersuite{strongSuite, ciphersuite.Noise255}
+	raw, _ := offerSuites(suites, ciphersuite.Noise255, "mail")
+
+	var (
+		config = new(Config)
+		key    = make([]byte, suite.DHLen())
+	)
+
+	offer, eph, err := config.parseOffer(append(raw, key...))
+
+	if err != nil || len(offer.suites) != 2 || offer.suites[0] != "Strong" || offer.suites[offer.keyed] != "Noise255" || offer.serverName != "mail" || !bytes.Equal(eph, key) {
+		t.Errorf("parseOffer(offer) = %+v, %x, %v; want [Strong Noise255], 1, \"mail\", %x, nil", offer, eph, err, key)
+	}
+
+	if _, _, err = config.parseOffer(append(raw, key[1:]...)); err != ErrBadEphemeral {
+		t.Errorf("parseOffer(short key) = %v; want %v", err, ErrBadEphemeral)
+	}
+
+	raw[1+2*suiteNameLen] = 2
+
+	if _, _, err = config.parseOffer(raw); err != ErrUnexpectedMessage {
+		t.Errorf("parseOffer(bad index) = %v; want %v", err, ErrUnexpectedMessage)
+	}
+
+	if _, _, err = config.parseOffer(raw[:10]); err != ErrShortMessage {
+		t.Errorf("parseOffer(truncated) = %v; want %v", err, ErrShortMessage)
+	}
+}
+
+func TestRunServerTruncatedEphemeral(t *testing.T) {
+	var (
+		clientConn, serverConn = net.Pipe()
+
+		done = make(chan error)
+	)
+
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		_, _, err := RunServer(NewStreamTransport(serverConn), nil)
+		done <- err
+	}()
+
+	offer, _ := offerSuites([]ciphersuite.Ciphersuite{suite}, suite, "")
+
+	// a valid offer, followed by no key at all
+	NewStreamTransport(clientConn).WriteMessage(append([]byte{firstNegotiate}, offer...))
+
+	if err := <-done; err != ErrBadEphemeral {
+		t.Errorf("RunServer(empty key) = %v; want %v", err, ErrBadEphemeral)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	var (
+		defaultKey = suite.NewKeypair()
+		mailKey    = suite.NewKeypair()
+
+		serverConfig = &Config{
+			Keypair: &defaultKey,
+			Hosts:   map[string]*ciphersuite.Keypair{"mail": &mailKey},
+		}
+	)
+
+	for _, test := range []struct {
+		serverName string
+		want       []byte
+	}{
+		{"mail", mailKey.Public},
+		{"", defaultKey.Public},
+		{"www", defaultKey.Public},
+	} {
+		client, server := handshakePair(t, &Config{ServerName: test.serverName}, serverConfig, nil)
+
+		if client.err != nil || !bytes.Equal(client.peerKey, test.want) {
+			t.Errorf("RunClient(%q) = %x, %v; want %x, nil", test.serverName, client.peerKey, client.err, test.want)
+		}
+
+		if server.session == nil || server.session.ServerName() != test.serverName {
+			t.Errorf("ServerName() = %v; want %q", server.session, test.serverName)
+		}
+	}
+}
+
+func TestServerNameEarly(t *testing.T) {
+	var (
+		defaultKey = suite.NewKeypair()
+		mailKey    = suite.NewKeypair()
+
+		clientConn, serverConn = net.Pipe()
+
+		done = make(chan *Session)
+	)
+
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		_, session, _ := RunServer(NewStreamTransport(serverConn), &Config{
+			Keypair: &defaultKey,
+			Hosts:   map[string]*ciphersuite.Keypair{"mail": &mailKey},
+		})
+		done <- session
+	}()
+
+	peerKey, _, err := RunClientEarly(NewStreamTransport(clientConn), &Config{ServerName: "mail"}, mailKey.Public, []byte("early"))
+
+	if err != nil || !bytes.Equal(peerKey, mailKey.Public) {
+		t.Fatalf("RunClientEarly() = %x, %v; want %x, nil", peerKey, err, mailKey.Public)
+	}
+
+	if session := <-done; session == nil || session.ServerName() != "mail" {
+		t.Errorf("ServerName() = %v; want \"mail\"", session)
+	}
+}
+
+func TestOfferServerNameTooLong(t *testing.T) {
+	long := string(bytes.Repeat([]byte("a"), serverNameLen+1))
+
+	if _, err := offerSuites([]ciphersuite.Ciphersuite{suite}, suite, long); err != ErrServerNameTooLong {
+		t.Errorf("offerSuites(long name) = %v; want %v", err, ErrServerNameTooLong)
+	}
+}
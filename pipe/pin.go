@@ -0,0 +1,48 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "crypto/subtle"
+import "errors"
+
+var ErrKeyNotPinned = errors.New("noise/pipe: peer key doesn't match any pinned key")
+
+// PinKeys returns a PeerVerifier that accepts only the given keys.
+// Passed to a client, it aborts the handshake before the client's
+// identity is sent to a server impersonating the expected one.
+func PinKeys(keys ...ciphersuite.PublicKey) PeerVerifier {
+	return func(peerKey ciphersuite.PublicKey) error {
+		match := 0
+
+		for _, key := range keys {
+			match |= subtle.ConstantTimeCompare(key, peerKey)
+		}
+
+		if match == 0 {
+			return ErrKeyNotPinned
+		}
+
+		return nil
+	}
+}
+
+// PinFingerprints is like PinKeys, but takes key fingerprints as
+// returned by Fingerprint.
+func PinFingerprints(fingerprints ...string) PeerVerifier {
+	return func(peerKey ciphersuite.PublicKey) error {
+		var (
+			fingerprint = []byte(Fingerprint(peerKey))
+			match       = 0
+		)
+
+		for _, pinned := range fingerprints {
+			match |= subtle.ConstantTimeCompare([]byte(pinned), fingerprint)
+		}
+
+		if match == 0 {
+			return ErrKeyNotPinned
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,161 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "time"
+
+// A RekeyPolicy says how often a session updates its keys with a fresh
+// DH exchange, so that compromising its current keys doesn't expose
+// later traffic. A key update is begun before sending data once any of
+// the nonzero limits has been reached since the last one.
+type RekeyPolicy struct {
+	Messages uint64
+	Bytes    uint64
+	Interval time.Duration
+}
+
+// SetRekeyPolicy sets when the session begins key updates of its own.
+// Key updates begun by the peer are always answered.
+func (s *Session) SetRekeyPolicy(policy RekeyPolicy) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.policy = policy
+}
+
+// Rekey begins a key update, unless one is already under way. It
+// completes once the peer's response has been read from the session.
+func (s *Session) Rekey() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if s.sendCC == nil {
+		return s.terminated()
+	}
+
+	return s.startRekey()
+}
+
+// Reports whether the policy calls for a key update. The caller must
+// hold sendMu.
+func (s *Session) rekeyDue() bool {
+	return (s.policy.Messages > 0 && s.sentMessages >= s.policy.Messages) ||
+		(s.policy.Bytes > 0 && s.sentBytes >= s.policy.Bytes) ||
+		(s.policy.Interval > 0 && time.Since(s.rekeyed) >= s.policy.Interval)
+}
+
+// A key update is made of two records in each direction. Each side
+// sends a fresh ephemeral key, either to begin the update or in answer
+// to the peer's. Once a side has both ephemeral keys, it mixes their DH
+// into the chain variable, and sends a record saying that everything
+// after it is under the new keys. Both sides may begin an update at
+// once, in which case neither needs to answer.
+//
+// Sends a fresh ephemeral key to the peer. The caller must hold sendMu.
+func (s *Session) startRekey() error {
+	if s.rekeyEph != nil || s.nextRecvCC != nil {
+		return nil
+	}
+
+	eph, err := s.newKeypair()
+
+	if err != nil {
+		return err
+	}
+
+	s.rekeyEph = &eph
+
+	return s.sendRecord(recordKeyUpdate, eph.Public)
+}
+
+// The caller must hold sendMu.
+func (s *Session) newKeypair() (ciphersuite.Keypair, error) {
+	if s.rand == nil {
+		return s.suite.NewKeypair(), nil
+	}
+
+	return s.suite.NewKeypairFrom(s.rand)
+}
+
+// Handles the peer's ephemeral key, answering it with one of our own if
+// we didn't begin the update. The caller must hold recvMu.
+func (s *Session) receiveKeyUpdate(peerEph []byte) (err error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if s.sendCC == nil {
+		return s.terminated()
+	}
+
+	if len(peerEph) != s.suite.DHLen() || s.nextRecvCC != nil {
+		return ErrUnexpectedMessage
+	}
+
+	// once closed for writing, we can't answer the peer, so it keeps
+	// its current keys
+	if s.writeClosed && s.rekeyEph == nil {
+		return nil
+	}
+
+	if s.rekeyEph == nil {
+		if err = s.startRekey(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		dh     = s.suite.DH(s.rekeyEph.Private, ciphersuite.PublicKey(peerEph))
+		cv, cc = s.suite.DeriveCVCC(s.chain, dh, kdfRekey)
+
+		clientCC, serverCC = s.suite.DeriveCCCC(cv)
+		sendCC, recvCC     = clientCC, serverCC
+	)
+
+	if !s.client {
+		sendCC, recvCC = serverCC, clientCC
+	}
+
+	wipe(dh)
+	wipe(cc)
+	wipe(s.chain)
+	wipe(s.rekeyEph.Private)
+
+	s.chain = cv
+	s.rekeyEph = nil
+	s.nextRecvCC = recvCC
+
+	if s.writeClosed {
+		wipe(sendCC)
+		return nil
+	}
+
+	if err = s.sendRecord(recordKeyChanged, nil); err != nil {
+		return err
+	}
+
+	wipe(s.sendCC)
+
+	s.sendCC = sendCC
+	s.sentMessages = 0
+	s.sentBytes = 0
+	s.rekeyed = time.Now()
+
+	return nil
+}
+
+// Switches to the peer's new sending key. The caller must hold recvMu.
+func (s *Session) receiveKeyChanged(payload []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if len(payload) != 0 || s.nextRecvCC == nil {
+		return ErrUnexpectedMessage
+	}
+
+	wipe(s.recvCC)
+
+	s.recvCC = s.nextRecvCC
+	s.nextRecvCC = nil
+
+	return nil
+}
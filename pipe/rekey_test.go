@@ -0,0 +1,92 @@
+package pipe
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// A buffered MessageTransport, so that both sides of a session can
+// write without waiting for the other to read.
+type chanTransport struct {
+	in  <-chan []byte
+	out chan<- []byte
+}
+
+func (t *chanTransport) WriteMessage(msg []byte) error {
+	t.out <- append([]byte(nil), msg...)
+	return nil
+}
+
+func (t *chanTransport) ReadMessage() ([]byte, error) {
+	return <-t.in, nil
+}
+
+func sessionPair() (client *Session, server *Session) {
+	var (
+		cv = suite.NewChain()
+
+		toClient = make(chan []byte, 64)
+		toServer = make(chan []byte, 64)
+	)
+
+	client = newSession(suite, &chanTransport{in: toClient, out: toServer}, cv, true)
+	server = newSession(suite, &chanTransport{in: toServer, out: toClient}, cv, false)
+
+	return
+}
+
+func exchange(t *testing.T, from *Session, to *Session, msg string) {
+	if err := from.WriteMessage([]byte(msg)); err != nil {
+		t.Fatalf("WriteMessage(%q) = %v; want nil", msg, err)
+	}
+
+	out, err := to.ReadMessage()
+
+	if err != nil || !bytes.Equal(out, []byte(msg)) {
+		t.Fatalf("ReadMessage() = %q, %v; want %q, nil", out, err, msg)
+	}
+}
+
+func TestSessionRekeyPolicy(t *testing.T) {
+	var (
+		client, server = sessionPair()
+
+		chain = append([]byte(nil), client.chain...)
+	)
+
+	client.SetRekeyPolicy(RekeyPolicy{Messages: 2})
+
+	for i := 0; i < 5; i++ {
+		exchange(t, client, server, fmt.Sprint("ping ", i))
+		exchange(t, server, client, fmt.Sprint("pong ", i))
+	}
+
+	if bytes.Equal(client.chain, chain) {
+		t.Error("chain after rekey is unchanged")
+	}
+
+	if !bytes.Equal(client.chain, server.chain) {
+		t.Errorf("client chain = %x; server chain = %x", client.chain, server.chain)
+	}
+}
+
+func TestSessionRekeySimultaneous(t *testing.T) {
+	client, server := sessionPair()
+
+	client.Rekey()
+	server.Rekey()
+
+	for i := 0; i < 2; i++ {
+		exchange(t, client, server, fmt.Sprint("ping ", i))
+		exchange(t, server, client, fmt.Sprint("pong ", i))
+	}
+
+	if client.nextRecvCC != nil || server.nextRecvCC != nil {
+		t.Error("key update is still under way")
+	}
+
+	if !bytes.Equal(client.chain, server.chain) {
+		t.Errorf("client chain = %x; server chain = %x", client.chain, server.chain)
+	}
+}
@@ -0,0 +1,225 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "context"
+import "encoding/binary"
+import "errors"
+
+var errResumeRejected = errors.New("noise/pipe: resumption ticket was rejected")
+
+// RunClientResume resumes a session using a ticket issued by the server
+// during an earlier one, exchanging fresh ephemeral keys in a single
+// round trip. If the server no longer accepts the ticket, it asks the
+// client to fall back to a full handshake, and the server's key must
+// then be accepted by the config's VerifyPeer.
+func RunClientResume(
+	transport MessageTransport,
+	config *Config,
+	ticket *Ticket,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	return RunClientResumeContext(context.Background(), transport, config, ticket)
+}
+
+// RunClientResumeContext is like RunClientResume, but gives up once ctx
+// is done.
+func RunClientResumeContext(
+	ctx context.Context,
+	transport MessageTransport,
+	config *Config,
+	ticket *Ticket,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	if config == nil {
+		config = new(Config)
+	}
+
+	ctx, cancel := config.handshakeContext(ctx)
+	defer cancel()
+
+	bound := withContext(ctx, transport)
+
+	return config.configure(bound.release(resumeClient(config.suite(), bound, transport, config, ticket)))
+}
+
+// Sends a ticket to the server along with a fresh ephemeral key, and
+// derives a session from the server's response, unless it asks to fall
+// back to a full handshake.
+func resumeClient(
+	suite ciphersuite.Ciphersuite,
+	bound MessageTransport,
+	transport MessageTransport,
+	config *Config,
+	ticket *Ticket,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	eph, err := config.newKeypair(suite)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer wipe(eph.Private)
+
+	var (
+		msg = make([]byte, 1+2+len(ticket.Ticket)+len(eph.Public))
+
+		resp []byte
+	)
+
+	if len(ticket.Ticket) > maxMessageLen/2 {
+		return nil, nil, ErrTicketInvalid
+	}
+
+	msg[0] = firstResume
+	binary.LittleEndian.PutUint16(msg[1:], uint16(len(ticket.Ticket)))
+	copy(msg[3:], ticket.Ticket)
+	copy(msg[3+len(ticket.Ticket):], eph.Public)
+
+	if err = bound.WriteMessage(msg); err != nil {
+		return nil, nil, err
+	}
+
+	if resp, err = bound.ReadMessage(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(resp) == 0 {
+		return nil, nil, ErrShortMessage
+	}
+
+	switch resp[0] {
+	case firstAccepted:
+	case firstRetry:
+		return runClient(bound, transport, config, nil)
+	default:
+		return nil, nil, ErrUnexpectedMessage
+	}
+
+	resp = resp[1:]
+
+	if len(resp) < suite.DHLen()+suite.MACLen() {
+		return nil, nil, ErrShortMessage
+	}
+
+	var (
+		peerEph = ciphersuite.PublicKey(resp[:suite.DHLen()])
+		confirm = resp[suite.DHLen():]
+	)
+
+	dh := suite.DH(eph.Private, peerEph)
+	cv, cc := suite.DeriveCVCC(ticket.secret, dh, kdfResume)
+
+	authtext := resumeAuthtext(ticket.Ticket, eph.Public, peerEph)
+
+	if _, err = suite.Decrypt(cc, confirm, authtext); err != nil {
+		return nil, nil, err
+	}
+
+	session = newSession(suite, transport, cv, true)
+	session.peerKey = ticket.ServerKey
+
+	return session.peerKey, session, nil
+}
+
+// Accepts a resumption message from a client, responding with a fresh
+// ephemeral key and a confirmation that the server could open the
+// ticket. If the ticket can't be opened, errResumeRejected is returned
+// and nothing is sent.
+func resumeServer(
+	suite ciphersuite.Ciphersuite,
+	bound MessageTransport,
+	transport MessageTransport,
+	msg []byte,
+	config *Config,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	tickets := config.Tickets
+
+	if tickets == nil || len(msg) < 2 {
+		return nil, nil, errResumeRejected
+	}
+
+	ticketLen := int(binary.LittleEndian.Uint16(msg))
+
+	if len(msg) != 2+ticketLen+suite.DHLen() {
+		return nil, nil, errResumeRejected
+	}
+
+	var (
+		ticket  = msg[2 : 2+ticketLen]
+		peerEph = ciphersuite.PublicKey(msg[2+ticketLen:])
+	)
+
+	peerKey, secret, err := tickets.open(ticket)
+
+	if err != nil {
+		return nil, nil, errResumeRejected
+	}
+
+	defer wipe(secret)
+
+	authorized, err := config.verifyClient(peerKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eph, err := config.newKeypair(suite)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer wipe(eph.Private)
+
+	dh := suite.DH(eph.Private, peerEph)
+	cv, cc := suite.DeriveCVCC(secret, dh, kdfResume)
+
+	authtext := resumeAuthtext(ticket, peerEph, eph.Public)
+	confirm := suite.Encrypt(cc, nil, authtext)
+
+	resp := make([]byte, 1+len(eph.Public)+len(confirm))
+	resp[0] = firstAccepted
+	copy(resp[1:], eph.Public)
+	copy(resp[1+len(eph.Public):], confirm)
+
+	if err = bound.WriteMessage(resp); err != nil {
+		return nil, nil, err
+	}
+
+	session = newSession(suite, transport, cv, false)
+	session.peerKey = append(ciphersuite.PublicKey(nil), peerKey...)
+	session.authorized = authorized
+
+	return session.peerKey, session, nil
+}
+
+func resumeAuthtext(
+	ticket []byte,
+	clientEph ciphersuite.PublicKey,
+	serverEph ciphersuite.PublicKey,
+) (
+	authtext []byte,
+) {
+	authtext = make([]byte, len(ticket)+len(clientEph)+len(serverEph))
+
+	copy(authtext[0:], ticket)
+	copy(authtext[len(ticket):], clientEph)
+	copy(authtext[len(ticket)+len(clientEph):], serverEph)
+
+	return
+}
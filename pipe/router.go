@@ -0,0 +1,72 @@
+package pipe
+
+import "net"
+import "sync"
+
+// A Router serves connections accepted by a Listener, handing each to
+// the handler for the application protocol its client picked.
+type Router struct {
+	mu        sync.Mutex
+	handlers  map[string]func(c *Conn)
+	protocols []string
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]func(c *Conn))}
+}
+
+// Handle registers handler for connections speaking protocol. Protocols
+// are offered to clients in the order they're registered. The handler
+// for "" serves clients that didn't pick a protocol. Connections are
+// closed once their handler returns.
+func (r *Router) Handle(protocol string, handler func(c *Conn)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.handlers[protocol]; !ok && protocol != "" {
+		r.protocols = append(r.protocols, protocol)
+	}
+
+	r.handlers[protocol] = handler
+}
+
+// Serve accepts connections from l until it fails, performing each
+// handshake and serving each connection in its own goroutine. The
+// handshakes use the listener's config, offering the protocols with
+// handlers in place of its own. Connections whose handshake fails, or
+// whose protocol has no handler, are closed.
+func (r *Router) Serve(l *Listener) error {
+	r.mu.Lock()
+	config := l.config.Clone()
+	config.Protocols = append([]string(nil), r.protocols...)
+	r.mu.Unlock()
+
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		go r.serve(conn, config)
+	}
+}
+
+func (r *Router) serve(conn net.Conn, config *Config) {
+	c, err := Server(conn, config)
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	defer c.Close()
+
+	r.mu.Lock()
+	handler := r.handlers[c.session.Protocol()]
+	r.mu.Unlock()
+
+	if handler != nil {
+		handler(c)
+	}
+}
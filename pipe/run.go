@@ -0,0 +1,599 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "context"
+import "errors"
+
+// A client's first message starts with a byte saying which handshake it
+// begins. A bare ephemeral key begins a full handshake without offering
+// any suites, using the server's most preferred one.
+const (
+	firstEarly     = 1
+	firstResume    = 2
+	firstNegotiate = 3
+)
+
+// The first byte of the server's response to an abbreviated handshake
+// says whether it was accepted or the client should fall back.
+const (
+	firstRetry    = 0
+	firstAccepted = 1
+)
+
+var ErrUnexpectedMessage = errors.New("noise/pipe: unexpected handshake message")
+
+// RunClient performs the client side of a handshake over transport,
+// returning the server's authenticated public key and a session for
+// talking to it.
+func RunClient(
+	transport MessageTransport,
+	config *Config,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	return RunClientContext(context.Background(), transport, config)
+}
+
+// RunClientContext is like RunClient, but gives up once ctx is done. The
+// handshake state is wiped either way, and ErrHandshakeTimeout is
+// returned if ctx's deadline passed.
+func RunClientContext(
+	ctx context.Context,
+	transport MessageTransport,
+	config *Config,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	if config == nil {
+		config = new(Config)
+	}
+
+	ctx, cancel := config.handshakeContext(ctx)
+	defer cancel()
+
+	bound := withContext(ctx, transport)
+
+	return config.configure(bound.release(runClient(bound, transport, config, nil)))
+}
+
+// RunClientEarly performs an abbreviated handshake with a server whose
+// key is already known, sending early data in the client's first
+// message rather than waiting a round trip. The server receives early
+// as the first message on its session. If the server's key has changed
+// it asks the client to fall back to a full handshake. The request isn't
+// authenticated, so the client only falls back if the config has a
+// VerifyPeer to accept the server's new key before early is resent, and
+// otherwise returns ErrEarlyRejected.
+//
+// Early data isn't forward secret and may be replayed to the server by
+// an attacker, so it shouldn't carry requests that aren't idempotent.
+func RunClientEarly(
+	transport MessageTransport,
+	config *Config,
+	serverKey ciphersuite.PublicKey,
+	early []byte,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	return RunClientEarlyContext(context.Background(), transport, config, serverKey, early)
+}
+
+// RunClientEarlyContext is like RunClientEarly, but gives up once ctx
+// is done.
+func RunClientEarlyContext(
+	ctx context.Context,
+	transport MessageTransport,
+	config *Config,
+	serverKey ciphersuite.PublicKey,
+	early []byte,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	if config == nil {
+		config = new(Config)
+	}
+
+	ctx, cancel := config.handshakeContext(ctx)
+	defer cancel()
+
+	bound := withContext(ctx, transport)
+
+	return config.configure(bound.release(runClientEarly(bound, transport, config, serverKey, early)))
+}
+
+// Performs an abbreviated handshake, falling back to a full one if the
+// server asks.
+func runClientEarly(
+	bound MessageTransport,
+	transport MessageTransport,
+	config *Config,
+	serverKey ciphersuite.PublicKey,
+	early []byte,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	var eph, syn []byte
+
+	handshake, err := config.clientHandshake(config.suite())
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer handshake.Terminate()
+
+	if eph, err = handshake.EarlyEph(serverKey, early, config.padLen(len(early))); err != nil {
+		return nil, nil, err
+	}
+
+	if err = bound.WriteMessage(append([]byte{firstEarly}, eph...)); err != nil {
+		return nil, nil, err
+	}
+
+	if syn, err = bound.ReadMessage(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(syn) == 0 {
+		return nil, nil, ErrShortMessage
+	}
+
+	switch syn[0] {
+	case firstAccepted:
+	case firstRetry:
+		// anyone can ask for a retry, so early is only resent to a
+		// key VerifyPeer accepts
+		if config.VerifyPeer == nil {
+			return nil, nil, ErrEarlyRejected
+		}
+
+		return runClient(bound, transport, config, early)
+	default:
+		return nil, nil, ErrUnexpectedMessage
+	}
+
+	if _, err = handshake.Syn(syn[1:]); err != nil {
+		return nil, nil, err
+	}
+
+	return finish(handshake, transport, nil)
+}
+
+// Performs a full handshake, offering the config's suites and sending
+// data in the client's Ack. The first suite is keyed for, and the
+// handshake is started over once if the server picks another.
+func runClient(
+	bound MessageTransport,
+	transport MessageTransport,
+	config *Config,
+	data []byte,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	var (
+		suites = config.suites()
+		suite  = suites[0]
+
+		handshake *ClientHandshake
+		protocol  string
+
+		offer, eph, syn, ack, payload []byte
+	)
+
+	for retried := false; ; retried = true {
+		if handshake, err = config.clientHandshake(suite); err != nil {
+			return nil, nil, err
+		}
+
+		defer handshake.Terminate()
+
+		if offer, err = offerSuites(suites, suite, config.ServerName); err != nil {
+			return nil, nil, err
+		}
+
+		if eph, err = handshake.Eph(); err != nil {
+			return nil, nil, err
+		}
+
+		msg := append(append([]byte{firstNegotiate}, offer...), eph...)
+
+		if err = bound.WriteMessage(msg); err != nil {
+			return nil, nil, err
+		}
+
+		if syn, err = bound.ReadMessage(); err != nil {
+			return nil, nil, err
+		}
+
+		if len(syn) == 0 {
+			return nil, nil, ErrShortMessage
+		}
+
+		if syn[0] == firstAccepted {
+			break
+		}
+
+		if syn[0] != firstRetry || retried {
+			return nil, nil, ErrUnexpectedMessage
+		}
+
+		// the server names the suite it picked, or none if there's
+		// nothing in common
+		if suite = config.findSuite(syn[1:]); suite == nil {
+			return nil, nil, ErrNoCommonSuite
+		}
+	}
+
+	if err = handshake.Bind(bindSuite(offer, suite)); err != nil {
+		return nil, nil, err
+	}
+
+	if payload, err = handshake.Syn(syn[1:]); err != nil {
+		return nil, nil, err
+	}
+
+	if payload, protocol, err = config.ackExtensions(payload, data); err != nil {
+		return nil, nil, err
+	}
+
+	if ack, err = handshake.Ack(payload, config.padLen(len(payload))); err != nil {
+		return nil, nil, err
+	}
+
+	if err = bound.WriteMessage(ack); err != nil {
+		return nil, nil, err
+	}
+
+	if peerKey, session, err = finish(handshake, transport, nil); err != nil {
+		return nil, nil, err
+	}
+
+	session.protocol = protocol
+
+	return peerKey, session, nil
+}
+
+// RunServer performs the server side of a handshake over transport,
+// returning the client's authenticated public key and a session for
+// talking to it. If the config has ticket keys, the client is issued a
+// ticket to resume the session with, and may itself resume a session
+// instead of performing a full handshake.
+func RunServer(
+	transport MessageTransport,
+	config *Config,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	return RunServerContext(context.Background(), transport, config)
+}
+
+// RunServerContext is like RunServer, but gives up once ctx is done. The
+// handshake state is wiped either way, and ErrHandshakeTimeout is
+// returned if ctx's deadline passed.
+func RunServerContext(
+	ctx context.Context,
+	transport MessageTransport,
+	config *Config,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	if config == nil {
+		config = new(Config)
+	}
+
+	ctx, cancel := config.handshakeContext(ctx)
+	defer cancel()
+
+	bound := withContext(ctx, transport)
+
+	return config.issue(config.configure(bound.release(runServer(bound, transport, config))))
+}
+
+func runServer(
+	bound MessageTransport,
+	transport MessageTransport,
+	config *Config,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	var (
+		suite = config.suite()
+		asked = false
+
+		offer *suiteOffer
+
+		msg, response, eph []byte
+	)
+
+	if msg, err = bound.ReadMessage(); err != nil {
+		return nil, nil, err
+	}
+
+	// the client may fall back from an abbreviated handshake and then
+	// be asked to retry with another suite, but no more
+	for first := true; ; first = false {
+		switch {
+		case len(msg) == suite.DHLen():
+			return serveFull(suite, nil, bound, transport, config, msg)
+		case len(msg) == 0:
+			return nil, nil, ErrShortMessage
+		case msg[0] == firstNegotiate:
+			if offer, eph, err = config.parseOffer(msg[1:]); err != nil {
+				return nil, nil, err
+			}
+
+			chosen := config.selectSuite(offer.suites)
+
+			if chosen == nil {
+				bound.WriteMessage([]byte{firstRetry})
+				return nil, nil, ErrNoCommonSuite
+			}
+
+			if chosen.Name() == offer.suites[offer.keyed] {
+				return serveFull(chosen, offer, bound, transport, config, eph)
+			}
+
+			// a client asked once already should have keyed for the
+			// suite it was told
+			if asked {
+				return nil, nil, ErrSuiteMismatch
+			}
+
+			asked = true
+			response = append([]byte{firstRetry}, encodeSuiteName(chosen)...)
+		case first && msg[0] == firstResume:
+			peerKey, session, err = resumeServer(suite, bound, transport, msg[1:], config)
+
+			if err == nil {
+				return peerKey, session, nil
+			}
+		case first && msg[0] == firstEarly:
+			peerKey, session, err = serveEarly(suite, bound, transport, config, msg[1:])
+
+			if err == nil {
+				return peerKey, session, nil
+			}
+		default:
+			return nil, nil, ErrUnexpectedMessage
+		}
+
+		// ask the client to fall back to a full handshake if its key
+		// or ticket are out of date
+		switch {
+		case response != nil:
+		case err == ErrEarlyRejected || err == errResumeRejected:
+			response = []byte{firstRetry}
+		default:
+			return nil, nil, err
+		}
+
+		if err = bound.WriteMessage(response); err != nil {
+			return nil, nil, err
+		}
+
+		if msg, err = bound.ReadMessage(); err != nil {
+			return nil, nil, err
+		}
+
+		response = nil
+	}
+}
+
+// Performs the rest of a full handshake begun by the client's eph,
+// identified by the keypair for the service it asked for. If the suite
+// was negotiated, the offer is bound into the handshake and the Syn
+// marked as accepting it.
+func serveFull(
+	suite ciphersuite.Ciphersuite,
+	offer *suiteOffer,
+	bound MessageTransport,
+	transport MessageTransport,
+	config *Config,
+	eph []byte,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	var (
+		protocol   string
+		serverName string
+		authorized *AuthorizedKey
+
+		syn, ack, data, payload []byte
+	)
+
+	if offer != nil {
+		serverName = offer.serverName
+	}
+
+	handshake, err := config.serverHandshake(suite, config.hostKeypair(serverName), &authorized)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer handshake.Terminate()
+
+	if err = handshake.Eph(eph); err != nil {
+		return nil, nil, err
+	}
+
+	if offer != nil {
+		if err = handshake.Bind(bindSuite(offer.raw, suite)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if payload, err = config.synExtensions(); err != nil {
+		return nil, nil, err
+	}
+
+	if syn, err = handshake.Syn(payload, config.padLen(len(payload))); err != nil {
+		return nil, nil, err
+	}
+
+	if offer != nil {
+		syn = append([]byte{firstAccepted}, syn...)
+	}
+
+	if err = bound.WriteMessage(syn); err != nil {
+		return nil, nil, err
+	}
+
+	if ack, err = bound.ReadMessage(); err != nil {
+		return nil, nil, err
+	}
+
+	if payload, err = handshake.Ack(ack); err != nil {
+		return nil, nil, err
+	}
+
+	if data, protocol, err = config.readAckExtensions(payload); err != nil {
+		return nil, nil, err
+	}
+
+	if peerKey, session, err = finish(handshake, transport, data); err != nil {
+		return nil, nil, err
+	}
+
+	session.protocol = protocol
+	session.serverName = serverName
+	session.authorized = authorized
+
+	return peerKey, session, nil
+}
+
+// Accepts early data sent with the client's eph, returning
+// ErrEarlyRejected if it wasn't sent to any of the server's keys.
+func serveEarly(
+	suite ciphersuite.Ciphersuite,
+	bound MessageTransport,
+	transport MessageTransport,
+	config *Config,
+	eph []byte,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	var authorized *AuthorizedKey
+
+	names, keyring := config.hostKeyring()
+	handshake, err := config.serverHandshake(suite, nil, &authorized)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer handshake.Terminate()
+
+	handshake.SetKeyring(keyring)
+
+	if peerKey, session, err = acceptEarly(handshake, bound, transport, config, eph); err != nil {
+		return nil, nil, err
+	}
+
+	session.serverName = names[handshake.KeyIndex()]
+	session.authorized = authorized
+
+	return peerKey, session, nil
+}
+
+func acceptEarly(
+	handshake *ServerHandshake,
+	bound MessageTransport,
+	transport MessageTransport,
+	config *Config,
+	eph []byte,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	var syn, data []byte
+
+	if data, err = handshake.EarlyEph(eph); err != nil {
+		return nil, nil, err
+	}
+
+	if syn, err = handshake.Syn(nil, config.padLen(0)); err != nil {
+		return nil, nil, err
+	}
+
+	if err = bound.WriteMessage(append([]byte{firstAccepted}, syn...)); err != nil {
+		return nil, nil, err
+	}
+
+	return finish(handshake, transport, data)
+}
+
+// Derives a session from a completed handshake. Any data the client
+// sent during the handshake becomes the first message on the session.
+func finish(
+	handshake Handshake,
+	transport MessageTransport,
+	data []byte,
+) (
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) {
+	if session, err = handshake.Session(transport); err != nil {
+		return nil, nil, err
+	}
+
+	if len(data) > 0 {
+		session.pending = append(session.pending, data)
+	}
+
+	session.peerKey = handshake.PeerPublicKey()
+
+	return session.peerKey, session, nil
+}
+
+// Issues a resumption ticket on a newly established server session,
+// once it's been configured.
+func (c *Config) issue(
+	peerKey ciphersuite.PublicKey,
+	session *Session,
+	err error,
+) (
+	ciphersuite.PublicKey,
+	*Session,
+	error,
+) {
+	if err != nil || c.Tickets == nil {
+		return peerKey, session, err
+	}
+
+	// a ticket too large for the frame limit is simply not issued, and
+	// the client does a full handshake next time
+	switch err = session.sendTicket(c.Tickets); err {
+	case nil, ErrMessageTooLong:
+	default:
+		session.Terminate()
+		return nil, nil, err
+	}
+
+	return peerKey, session, nil
+}
@@ -0,0 +1,349 @@
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+type runResult struct {
+	peerKey []byte
+	session *Session
+	err     error
+}
+
+// Rewrites the first message written through it.
+type tamperTransport struct {
+	MessageTransport
+	tamper func(msg []byte) []byte
+}
+
+func (t *tamperTransport) WriteMessage(msg []byte) error {
+	if t.tamper != nil {
+		msg, t.tamper = t.tamper(msg), nil
+	}
+
+	return t.MessageTransport.WriteMessage(msg)
+}
+
+// Runs a full handshake over a pipe between a client and a server
+// configured by clientConfig and serverConfig, returning both ends
+// whether or not it succeeds. If tamper is non-nil, it rewrites the
+// client's first message.
+func handshakePair(
+	t *testing.T,
+	clientConfig *Config,
+	serverConfig *Config,
+	tamper func(msg []byte) []byte,
+) (
+	client runResult,
+	server runResult,
+) {
+	var (
+		clientConn, serverConn = net.Pipe()
+
+		transport = NewStreamTransport(clientConn)
+		done      = make(chan runResult)
+	)
+
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	go func() {
+		var r runResult
+
+		r.peerKey, r.session, r.err = RunServer(NewStreamTransport(serverConn), serverConfig)
+		done <- r
+	}()
+
+	if tamper != nil {
+		transport = &tamperTransport{transport, tamper}
+	}
+
+	client.peerKey, client.session, client.err = RunClient(transport, clientConfig)
+
+	// unblock a server left waiting on a client that gave up
+	if client.err != nil {
+		clientConn.Close()
+	}
+
+	return client, <-done
+}
+
+func runPair(t *testing.T) (client runResult, server runResult) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+	)
+
+	client, server = handshakePair(t, &Config{Keypair: &clientKey}, &Config{Keypair: &serverKey}, nil)
+
+	if client.err != nil || server.err != nil {
+		t.Fatalf("RunClient() = %v, RunServer() = %v; want nil, nil", client.err, server.err)
+	}
+
+	if !bytes.Equal(client.peerKey, serverKey.Public) {
+		t.Errorf("RunClient() peerKey = %x; want %x", client.peerKey, serverKey.Public)
+	}
+
+	if !bytes.Equal(server.peerKey, clientKey.Public) {
+		t.Errorf("RunServer() peerKey = %x; want %x", server.peerKey, clientKey.Public)
+	}
+
+	return
+}
+
+func TestRunSession(t *testing.T) {
+	client, server := runPair(t)
+
+	go client.session.WriteMessage([]byte("ping"))
+
+	msg, err := server.session.ReadMessage()
+
+	if err != nil || !bytes.Equal(msg, []byte("ping")) {
+		t.Errorf("ReadMessage() = %q, %v; want \"ping\", nil", msg, err)
+	}
+}
+
+func TestRunClientContextTimeout(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+
+		clientConn, serverConn = net.Pipe()
+	)
+
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// drain the client's ephemeral key, but never respond
+	go serverConn.Read(make([]byte, 1024))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, _, err := RunClientContext(ctx, NewStreamTransport(clientConn), &Config{Keypair: &clientKey})
+
+	if err != ErrHandshakeTimeout {
+		t.Errorf("RunClientContext() = %v; want %v", err, ErrHandshakeTimeout)
+	}
+}
+
+func TestRunClientContextAbandoned(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+
+		toClient = make(chan []byte, 1)
+		toServer = make(chan []byte, 1)
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// a transport without deadlines, whose read is abandoned
+	_, _, err := RunClientContext(ctx, &chanTransport{in: toClient, out: toServer}, &Config{Keypair: &clientKey})
+
+	if err != ErrHandshakeTimeout {
+		t.Errorf("RunClientContext() = %v; want %v", err, ErrHandshakeTimeout)
+	}
+
+	// let the abandoned read finish
+	toClient <- []byte("late")
+}
+
+func TestRunContextKeepsDeadline(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+
+		clientConn, serverConn = net.Pipe()
+
+		done = make(chan error)
+	)
+
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	clientConn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+
+	go func() {
+		_, _, err := RunServer(NewStreamTransport(serverConn), &Config{Keypair: &serverKey})
+		done <- err
+	}()
+
+	_, session, err := RunClientContext(context.Background(), NewStreamTransport(clientConn), &Config{Keypair: &clientKey})
+
+	if err != nil {
+		t.Fatalf("RunClientContext() = %v; want nil", err)
+	}
+
+	<-done
+
+	// the server never writes, so only the deadline ends the read
+	if _, err = session.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadMessage() = %v; want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestRunClientEarly(t *testing.T) {
+	for _, changed := range []bool{false, true} {
+		var (
+			clientKey = suite.NewKeypair()
+			serverKey = suite.NewKeypair()
+			knownKey  = serverKey.Public
+
+			clientConn, serverConn = net.Pipe()
+
+			done = make(chan *Session)
+		)
+
+		if changed {
+			knownKey = suite.NewKeypair().Public
+		}
+
+		go func() {
+			_, session, _ := RunServer(NewStreamTransport(serverConn), &Config{Keypair: &serverKey})
+			done <- session
+		}()
+
+		config := &Config{
+			Keypair:    &clientKey,
+			VerifyPeer: PinFingerprints(Fingerprint(serverKey.Public)),
+		}
+
+		peerKey, _, err := RunClientEarly(NewStreamTransport(clientConn), config, knownKey, []byte("early"))
+
+		if err != nil {
+			t.Fatalf("RunClientEarly(changed = %v) = %v; want nil", changed, err)
+		}
+
+		if !bytes.Equal(peerKey, serverKey.Public) {
+			t.Errorf("RunClientEarly(changed = %v) peerKey = %x; want %x", changed, peerKey, serverKey.Public)
+		}
+
+		msg, err := (<-done).ReadMessage()
+
+		if err != nil || !bytes.Equal(msg, []byte("early")) {
+			t.Errorf("ReadMessage(changed = %v) = %q, %v; want \"early\", nil", changed, msg, err)
+		}
+
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func TestRunClientEarlyRetryUnverified(t *testing.T) {
+	for _, verify := range []PeerVerifier{nil, PinFingerprints(Fingerprint(suite.NewKeypair().Public))} {
+		var (
+			clientKey = suite.NewKeypair()
+			serverKey = suite.NewKeypair()
+			knownKey  = suite.NewKeypair().Public
+
+			clientConn, serverConn = net.Pipe()
+
+			done = make(chan runResult)
+		)
+
+		// the responder has a different key from the one the client
+		// knows, so it asks for a retry
+		go func() {
+			var r runResult
+
+			r.peerKey, r.session, r.err = RunServer(NewStreamTransport(serverConn), &Config{Keypair: &serverKey})
+			done <- r
+		}()
+
+		config := &Config{Keypair: &clientKey, VerifyPeer: verify}
+
+		_, _, err := RunClientEarly(NewStreamTransport(clientConn), config, knownKey, []byte("early"))
+
+		if err == nil || (verify == nil && err != ErrEarlyRejected) {
+			t.Errorf("RunClientEarly(VerifyPeer = %v) = %v; want error", verify != nil, err)
+		}
+
+		clientConn.Close()
+
+		if server := <-done; server.err == nil {
+			t.Errorf("RunServer(VerifyPeer = %v) = nil; want error without the early data", verify != nil)
+		}
+
+		serverConn.Close()
+	}
+}
+
+func TestRunClientResume(t *testing.T) {
+	var (
+		clientKey = suite.NewKeypair()
+		serverKey = suite.NewKeypair()
+	)
+
+	tickets, err := NewTicketKeys(suite, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server's ticket is read along with its greeting, since an
+	// unbuffered pipe blocks the server until the client reads
+	run := func(client func(MessageTransport) (*Session, error)) *Session {
+		clientConn, serverConn := net.Pipe()
+		done := make(chan struct{})
+
+		t.Cleanup(func() {
+			clientConn.Close()
+			serverConn.Close()
+		})
+
+		go func() {
+			defer close(done)
+
+			_, session, err := RunServer(NewStreamTransport(serverConn), &Config{Keypair: &serverKey, Tickets: tickets})
+
+			if err != nil {
+				t.Errorf("RunServer() = %v; want nil", err)
+				return
+			}
+
+			session.WriteMessage([]byte("hello"))
+		}()
+
+		session, err := client(NewStreamTransport(clientConn))
+
+		if err != nil {
+			t.Fatalf("client = %v; want nil", err)
+		}
+
+		if msg, err := session.ReadMessage(); err != nil || !bytes.Equal(msg, []byte("hello")) {
+			t.Fatalf("ReadMessage() = %q, %v; want \"hello\", nil", msg, err)
+		}
+
+		<-done
+
+		return session
+	}
+
+	session := run(func(transport MessageTransport) (*Session, error) {
+		_, session, err := RunClient(transport, &Config{Keypair: &clientKey})
+		return session, err
+	})
+
+	ticket := session.Ticket()
+
+	if ticket == nil {
+		t.Fatal("Ticket() = nil; want ticket")
+	}
+
+	session = run(func(transport MessageTransport) (*Session, error) {
+		_, session, err := RunClientResume(transport, &Config{Keypair: &clientKey}, ticket)
+		return session, err
+	})
+
+	if session.Ticket() == nil {
+		t.Error("Ticket() after resumption = nil; want ticket")
+	}
+}
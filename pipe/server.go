@@ -3,33 +3,219 @@ package pipe
 import "github.com/stouset/go.noise/box"
 import "github.com/stouset/go.noise/ciphersuite"
 
-type serverHandshake struct {
+import "io"
+
+// ServerHandshake performs the server side of a handshake.
+type ServerHandshake struct {
+	handshakeState
+
 	context box.Context
+	verify  PeerVerifier
+
+	suite     ciphersuite.Ciphersuite
+	serverKey *ciphersuite.Keypair
+	keyring   box.Keyring
+	index     int
+	rand      io.Reader
+
+	// whether the handshake was abbreviated by EarlyEph
+	early bool
 }
 
 func NewServerHandshake(
 	suite ciphersuite.Ciphersuite,
 	serverKey *ciphersuite.Keypair,
 ) (
-	handshake *serverHandshake,
+	handshake *ServerHandshake,
 ) {
-	return &serverHandshake{
-		context: *box.NewContext(suite, serverKey, 1),
+	return &ServerHandshake{
+		context:   *box.NewContext(suite, serverKey, 1),
+		suite:     suite,
+		serverKey: serverKey,
 	}
 }
 
-func (h *serverHandshake) Eph(eph []byte) {
+// SetPeerVerifier makes Ack fail unless verify accepts the client's
+// key.
+func (h *ServerHandshake) SetPeerVerifier(verify PeerVerifier) {
+	h.verify = verify
+}
+
+// SetKeyring makes EarlyEph accept early data shut to any of the keys
+// in keyring, rather than only to the server's key. Every key is tried,
+// so the time taken doesn't reveal which one matched; KeyIndex reports
+// it. A full handshake has to commit to a key before the client sends
+// anything it could be tried against, so it still uses the server's
+// key.
+func (h *ServerHandshake) SetKeyring(keyring box.Keyring) {
+	h.keyring = keyring
+}
+
+// KeyIndex returns the index in the keyring of the key the client's
+// early data was shut to, once EarlyEph has accepted it.
+func (h *ServerHandshake) KeyIndex() int {
+	return h.index
+}
+
+// SetEntropy makes the handshake draw its ephemeral keys from rand. It
+// must be called before the first step of the handshake.
+func (h *ServerHandshake) SetEntropy(rand io.Reader) error {
+	h.rand = rand
+
+	return h.context.SetEntropy(rand)
+}
+
+func (h *ServerHandshake) Eph(eph []byte) (err error) {
+	if err = h.expect(StateEph); err != nil {
+		return err
+	}
+
+	if len(eph) != h.suite.DHLen() {
+		h.fail()
+		return ErrBadEphemeral
+	}
+
 	h.context.Init(ciphersuite.PublicKey(eph))
+	h.state = StateSyn
+
+	return nil
 }
 
-func (h *serverHandshake) Syn(data []byte, padLen uint32) (syn []byte) {
-	return h.context.Shut(data, 1, padLen)
+// EarlyEph accepts the first message of an abbreviated handshake, as
+// returned by the client's EarlyEph, and returns the client's early
+// data. If the box wasn't shut to this server's key, or to one in its
+// keyring, ErrEarlyRejected is returned and the handshake is left ready
+// to accept a new Eph, so that the client can fall back to a full
+// handshake.
+func (h *ServerHandshake) EarlyEph(eph []byte) (data []byte, err error) {
+	if err = h.expect(StateEph); err != nil {
+		return nil, err
+	}
+
+	keyring := h.keyring
+
+	if keyring == nil && h.serverKey != nil {
+		keyring = box.Keyring{h.serverKey}
+	}
+
+	// without a static key, no box could have been shut to it
+	if len(keyring) == 0 {
+		return nil, ErrEarlyRejected
+	}
+
+	context, index, data, err := keyring.Open(h.suite, eph, nil, 1)
+
+	if err != nil {
+		return nil, ErrEarlyRejected
+	}
+
+	if h.rand != nil {
+		context.SetEntropy(h.rand)
+	}
+
+	h.context.Terminate()
+	h.context = *context
+
+	if h.verify != nil {
+		if err = h.verify(h.context.PeerPublicKey()); err != nil {
+			h.fail()
+			return nil, err
+		}
+	}
+
+	h.index = index
+	h.state = StateSyn
+	h.early = true
+
+	return data, nil
 }
 
-func (h *serverHandshake) Ack(ack []byte) (data []byte, err error) {
-	return h.context.Open(ack, 2)
+// Bind mixes data into the handshake, so that it only completes if the
+// client binds the same data. It must be called between Eph and Syn.
+func (h *ServerHandshake) Bind(data []byte) error {
+	if err := h.expect(StateSyn); err != nil {
+		return err
+	}
+
+	h.context.MixChainVariable(data, kdfBind)
+
+	return nil
+}
+
+func (h *ServerHandshake) Syn(data []byte, padLen uint32) (syn []byte, err error) {
+	if err = h.expect(StateSyn); err != nil {
+		return nil, err
+	}
+
+	if h.early {
+		if syn, err = h.context.Reply(data, nil, padLen); err != nil {
+			h.fail()
+			return nil, err
+		}
+
+		h.state = StateDone
+
+		return syn, nil
+	}
+
+	if syn, err = h.context.Shut(data, nil, 1, padLen); err != nil {
+		h.fail()
+		return nil, err
+	}
+
+	h.state = StateAck
+
+	return syn, nil
+}
+
+func (h *ServerHandshake) Ack(ack []byte) (data []byte, err error) {
+	if err = h.expect(StateAck); err != nil {
+		return nil, err
+	}
+
+	if data, err = h.context.Open(ack, nil, 2); err != nil {
+		h.fail()
+		return nil, err
+	}
+
+	if h.verify != nil {
+		if err = h.verify(h.context.PeerPublicKey()); err != nil {
+			h.fail()
+			return nil, err
+		}
+	}
+
+	h.state = StateDone
+
+	return data, nil
+}
+
+// PeerPublicKey returns the client's static public key, once it has been
+// authenticated.
+func (h *ServerHandshake) PeerPublicKey() ciphersuite.PublicKey {
+	if h.state == StateFailed || h.state == StateTerminated {
+		return nil
+	}
+
+	return h.context.PeerPublicKey()
+}
+
+// Session returns a session for exchanging messages with the peer
+// over transport. The handshake must be done.
+func (h *ServerHandshake) Session(transport MessageTransport) (session *Session, err error) {
+	if err = h.expect(StateDone); err != nil {
+		return nil, err
+	}
+
+	return newSession(h.context.Suite(), transport, h.context.ChainVariable(), false), nil
+}
+
+func (h *ServerHandshake) Terminate() {
+	h.context.Terminate()
+	h.state = StateTerminated
 }
 
-func (h *serverHandshake) Terminate() {
+func (h *ServerHandshake) fail() {
 	h.context.Terminate()
+	h.state = StateFailed
 }
@@ -0,0 +1,391 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "encoding/binary"
+import "errors"
+import "io"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Each message on a session is a record, whose first byte says what
+// it carries.
+const (
+	recordData       = 0
+	recordTicket     = 1
+	recordKeyUpdate  = 2
+	recordKeyChanged = 3
+	recordClose      = 4
+	recordKeepalive  = 5
+)
+
+var (
+	ErrShortMessage      = errors.New("noise/pipe: message is too short")
+	ErrSessionTerminated = errors.New("noise/pipe: session has been terminated")
+	ErrUnknownRecord     = errors.New("noise/pipe: unknown record type")
+	ErrWriteClosed       = errors.New("noise/pipe: session is closed for writing")
+)
+
+// A Session exchanges encrypted messages with the peer over a
+// transport, once a handshake has completed. It is itself a
+// MessageTransport.
+type Session struct {
+	suite     ciphersuite.Ciphersuite
+	transport MessageTransport
+
+	// recvMu is always locked before sendMu, since reading a key
+	// update sends one in answer
+	sendMu sync.Mutex
+	sendCC ciphersuite.CipherContext
+
+	recvMu sync.Mutex
+	recvCC ciphersuite.CipherContext
+
+	// whether each side has sent a close record
+	writeClosed bool
+	readClosed  bool
+
+	// messages received during the handshake, yet to be read
+	pending [][]byte
+
+	client     bool
+	maxFrame   int
+	peerKey    ciphersuite.PublicKey
+	protocol   string
+	serverName string
+	authorized *AuthorizedKey
+	resumption ciphersuite.ChainVariable
+	ticket     *Ticket
+
+	// secrets derived from the handshake's final chain variable, which
+	// don't change when keys are updated
+	exporter ciphersuite.ChainVariable
+	binding  []byte
+
+	// key updates, guarded by sendMu
+	chain        ciphersuite.ChainVariable
+	policy       RekeyPolicy
+	rand         io.Reader
+	rekeyEph     *ciphersuite.Keypair
+	nextRecvCC   ciphersuite.CipherContext
+	sentMessages uint64
+	sentBytes    uint64
+	rekeyed      time.Time
+
+	stats         sessionStats
+	idle          atomic.Bool
+	stopKeepalive chan struct{}
+
+	// when the pending read began waiting on the transport, in Unix
+	// nanoseconds, or zero if there is none
+	readSince atomic.Int64
+}
+
+func newSession(
+	suite ciphersuite.Ciphersuite,
+	transport MessageTransport,
+	cv ciphersuite.ChainVariable,
+	client bool,
+) (
+	session *Session,
+) {
+	clientCC, serverCC := suite.DeriveCCCC(cv)
+
+	session = &Session{
+		suite:      suite,
+		transport:  transport,
+		sendCC:     clientCC,
+		recvCC:     serverCC,
+		client:     client,
+		maxFrame:   maxMessageLen,
+		resumption: resumptionSecret(suite, cv),
+		exporter:   exporterSecret(suite, cv),
+		binding:    channelBinding(suite, cv),
+		chain:      append(ciphersuite.ChainVariable(nil), cv...),
+		rekeyed:    time.Now(),
+	}
+
+	session.stats.Established = session.rekeyed
+
+	if !client {
+		session.sendCC, session.recvCC = serverCC, clientCC
+	}
+
+	return
+}
+
+func (s *Session) WriteMessage(data []byte) error {
+	if len(data) > s.maxDataLen() {
+		return ErrMessageTooLong
+	}
+
+	return s.writeRecord(recordData, data)
+}
+
+func (s *Session) ReadMessage() (data []byte, err error) {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	if s.recvCC == nil {
+		return nil, s.terminated()
+	}
+
+	if len(s.pending) > 0 {
+		data, s.pending = s.pending[0], s.pending[1:]
+		return data, nil
+	}
+
+	if s.readClosed {
+		return nil, io.EOF
+	}
+
+	for {
+		recordType, payload, err := s.readRecord()
+
+		// only a close record ends the session cleanly; the transport
+		// ending first may be an attacker truncating it
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		if err != nil && s.idle.Load() {
+			return nil, ErrIdleTimeout
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch recordType {
+		case recordData:
+			return payload, nil
+		case recordTicket:
+			err = s.receiveTicket(payload)
+		case recordKeyUpdate:
+			err = s.receiveKeyUpdate(payload)
+		case recordKeyChanged:
+			err = s.receiveKeyChanged(payload)
+		case recordKeepalive:
+		case recordClose:
+			if len(payload) != 0 {
+				return nil, ErrUnexpectedMessage
+			}
+
+			s.readClosed = true
+
+			return nil, io.EOF
+		default:
+			err = ErrUnknownRecord
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Protocol returns the application protocol negotiated by the
+// handshake, or "" if there was none.
+func (s *Session) Protocol() string {
+	return s.protocol
+}
+
+// ServerName returns the name of the service the client asked for, on
+// the server's side of the session. It is "" if the client named none,
+// or the session was resumed.
+func (s *Session) ServerName() string {
+	return s.serverName
+}
+
+// AuthorizedKey returns the authorized keys entry the client's key
+// matched, on the server's side of a session whose config had
+// AuthorizedKeys, so that its options can be applied. It is nil
+// otherwise.
+func (s *Session) AuthorizedKey() *AuthorizedKey {
+	return s.authorized
+}
+
+// Ticket returns the most recent resumption ticket the server has
+// issued on this session, or nil if there is none. Tickets are only
+// received while reading from the session.
+func (s *Session) Ticket() *Ticket {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	return s.ticket
+}
+
+func (s *Session) writeRecord(recordType byte, payload []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if s.sendCC == nil {
+		return s.terminated()
+	}
+
+	if s.writeClosed {
+		return ErrWriteClosed
+	}
+
+	if recordType == recordData && s.rekeyDue() {
+		if err := s.startRekey(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.sendRecord(recordType, payload); err != nil {
+		return err
+	}
+
+	if recordType == recordClose {
+		s.writeClosed = true
+	}
+
+	return nil
+}
+
+// CloseWrite tells the peer that nothing more will be sent, after which
+// its reads return io.EOF. The session can still be read from.
+func (s *Session) CloseWrite() error {
+	return s.writeRecord(recordClose, nil)
+}
+
+// Encrypts and sends a record. The caller must hold sendMu.
+func (s *Session) sendRecord(recordType byte, payload []byte) error {
+	record := make([]byte, 1+len(payload))
+	record[0] = recordType
+	copy(record[1:], payload)
+
+	msg := s.suite.Encrypt(s.sendCC, record, nil)
+
+	if err := s.transport.WriteMessage(msg); err != nil {
+		return err
+	}
+
+	s.stats.sent(len(msg))
+	s.sentMessages++
+	s.sentBytes += uint64(len(payload))
+
+	return nil
+}
+
+// Reads and decrypts the next record. The caller must hold recvMu.
+func (s *Session) readRecord() (recordType byte, payload []byte, err error) {
+	s.readSince.Store(time.Now().UnixNano())
+	msg, err := s.transport.ReadMessage()
+	s.readSince.Store(0)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(msg) < s.suite.MACLen()+1 {
+		return 0, nil, ErrShortMessage
+	}
+
+	if len(msg) > s.maxFrame {
+		return 0, nil, ErrMessageTooLong
+	}
+
+	record, err := s.suite.Decrypt(s.recvCC, msg, nil)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	s.stats.received(len(msg))
+
+	return record[0], record[1:], nil
+}
+
+// The most data that fits in a single record.
+func (s *Session) maxDataLen() int {
+	return s.maxFrame - s.suite.MACLen() - 1
+}
+
+// The smallest frame that can carry a key update record, or a
+// multiplexed frame with a byte of data.
+func minFrameSize(suite ciphersuite.Ciphersuite) int {
+	return suite.MACLen() + 1 + max(suite.DHLen(), frameHeaderLen+1)
+}
+
+// Issues the client a ticket it can use to resume this session.
+func (s *Session) sendTicket(keys *TicketKeys) error {
+	ticket, expires, err := keys.seal(s.peerKey, s.resumption)
+
+	if err != nil {
+		return err
+	}
+
+	if 8+len(ticket) > s.maxDataLen() {
+		return ErrMessageTooLong
+	}
+
+	payload := make([]byte, 8+len(ticket))
+	binary.LittleEndian.PutUint64(payload, uint64(expires.Unix()))
+	copy(payload[8:], ticket)
+
+	return s.writeRecord(recordTicket, payload)
+}
+
+func (s *Session) receiveTicket(payload []byte) error {
+	if !s.client || len(payload) < 8 {
+		return ErrUnexpectedMessage
+	}
+
+	s.ticket = &Ticket{
+		Ticket:    append([]byte(nil), payload[8:]...),
+		ServerKey: s.peerKey,
+		Expires:   time.Unix(int64(binary.LittleEndian.Uint64(payload)), 0),
+		secret:    append(ciphersuite.ChainVariable(nil), s.resumption...),
+	}
+
+	return nil
+}
+
+// Terminate wipes the session's cipher contexts. The session can't be
+// used afterward.
+func (s *Session) Terminate() {
+	s.recvMu.Lock()
+	s.sendMu.Lock()
+	defer s.recvMu.Unlock()
+	defer s.sendMu.Unlock()
+
+	wipe(s.sendCC)
+	wipe(s.recvCC)
+	wipe(s.nextRecvCC)
+	wipe(s.resumption)
+	wipe(s.chain)
+	wipe(s.exporter)
+
+	if s.rekeyEph != nil {
+		wipe(s.rekeyEph.Private)
+	}
+
+	s.sendCC = nil
+	s.recvCC = nil
+	s.nextRecvCC = nil
+	s.rekeyEph = nil
+	s.exporter = nil
+
+	if s.stopKeepalive != nil {
+		close(s.stopKeepalive)
+		s.stopKeepalive = nil
+	}
+}
+
+// The error returned once the session has been terminated.
+func (s *Session) terminated() error {
+	if s.idle.Load() {
+		return ErrIdleTimeout
+	}
+
+	return ErrSessionTerminated
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,229 @@
+package pipe
+
+import "github.com/stouset/go.noise/ciphersuite"
+
+import "bytes"
+import "crypto/rand"
+import "encoding/binary"
+import "errors"
+import "sync"
+import "time"
+
+// Numbers distinguishing the pipe's own key derivations from the ones
+// made by box.
+const (
+	kdfResumption = 16
+	kdfTicket     = 17
+	kdfResume     = 18
+	kdfRekey      = 19
+
+	kdfDatagramClient = 20
+	kdfDatagramServer = 21
+	kdfDatagramPacket = 22
+
+	kdfBind = 23
+
+	kdfExporter = 24
+	kdfBinding  = 25
+)
+
+const (
+	ticketIdLen    = 4
+	ticketNonceLen = 16
+	ticketKeyLen   = 32
+)
+
+var (
+	ErrTicketExpired = errors.New("noise/pipe: resumption ticket has expired")
+	ErrTicketUnknown = errors.New("noise/pipe: resumption ticket key is unknown")
+	ErrTicketInvalid = errors.New("noise/pipe: resumption ticket is invalid")
+)
+
+// TicketKeys are the server-side keys that resumption tickets are
+// sealed with. A ticket is valid for lifetime after it is issued, and
+// can be opened for as long as the key that sealed it is retained.
+type TicketKeys struct {
+	mu sync.Mutex
+
+	suite    ciphersuite.Ciphersuite
+	lifetime time.Duration
+	now      func() time.Time
+
+	// newest first; only the first is used to seal new tickets
+	keys []*ticketKey
+}
+
+type ticketKey struct {
+	id      [ticketIdLen]byte
+	key     ciphersuite.SymmetricKey
+	retired time.Time
+}
+
+// A Ticket lets a client resume a session with the server that issued
+// it, without repeating the full handshake.
+type Ticket struct {
+	// Ticket is the opaque ticket, sealed under the server's ticket key.
+	Ticket []byte
+
+	ServerKey ciphersuite.PublicKey
+	Expires   time.Time
+
+	secret ciphersuite.ChainVariable
+}
+
+func NewTicketKeys(
+	suite ciphersuite.Ciphersuite,
+	lifetime time.Duration,
+) (
+	k *TicketKeys,
+	err error,
+) {
+	k = &TicketKeys{
+		suite:    suite,
+		lifetime: lifetime,
+		now:      time.Now,
+	}
+
+	if err = k.Rotate(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Rotate starts sealing tickets with a fresh key. Older keys are kept
+// only until the last tickets they sealed have expired.
+func (k *TicketKeys) Rotate() error {
+	key := &ticketKey{key: make([]byte, ticketKeyLen)}
+
+	if _, err := rand.Read(key.id[:]); err != nil {
+		return err
+	}
+
+	if _, err := rand.Read(key.key); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := k.now()
+
+	if len(k.keys) > 0 {
+		k.keys[0].retired = now
+	}
+
+	live := []*ticketKey{key}
+
+	for _, old := range k.keys {
+		if now.Sub(old.retired) < k.lifetime {
+			live = append(live, old)
+		} else {
+			wipe(old.key)
+		}
+	}
+
+	k.keys = live
+
+	return nil
+}
+
+// Seals a ticket for a client, returning it along with its expiry.
+func (k *TicketKeys) seal(
+	clientKey ciphersuite.PublicKey,
+	secret ciphersuite.ChainVariable,
+) (
+	ticket []byte,
+	expires time.Time,
+	err error,
+) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var (
+		key       = k.keys[0]
+		header    = make([]byte, ticketIdLen+ticketNonceLen)
+		plaintext = make([]byte, 8+len(clientKey)+len(secret))
+	)
+
+	expires = k.now().Add(k.lifetime)
+
+	copy(header, key.id[:])
+
+	if _, err = rand.Read(header[ticketIdLen:]); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	binary.LittleEndian.PutUint64(plaintext, uint64(expires.Unix()))
+	copy(plaintext[8:], clientKey)
+	copy(plaintext[8+len(clientKey):], secret)
+
+	_, cc := k.suite.DeriveCVCC(header[ticketIdLen:], key.key, kdfTicket)
+	ciphertext := k.suite.Encrypt(cc, plaintext, header)
+
+	return append(header, ciphertext...), expires, nil
+}
+
+// Opens a ticket, returning the client key and resumption secret of the
+// session it was issued for.
+func (k *TicketKeys) open(
+	ticket []byte,
+) (
+	clientKey ciphersuite.PublicKey,
+	secret ciphersuite.ChainVariable,
+	err error,
+) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var (
+		headerLen = ticketIdLen + ticketNonceLen
+		key       *ticketKey
+	)
+
+	if len(ticket) < headerLen+k.suite.MACLen()+8+k.suite.DHLen() {
+		return nil, nil, ErrTicketInvalid
+	}
+
+	for _, candidate := range k.keys {
+		if bytes.Equal(candidate.id[:], ticket[:ticketIdLen]) {
+			key = candidate
+		}
+	}
+
+	if key == nil {
+		return nil, nil, ErrTicketUnknown
+	}
+
+	header := ticket[:headerLen]
+	_, cc := k.suite.DeriveCVCC(header[ticketIdLen:], key.key, kdfTicket)
+	plaintext, err := k.suite.Decrypt(cc, ticket[headerLen:], header)
+
+	if err != nil {
+		return nil, nil, ErrTicketInvalid
+	}
+
+	expires := time.Unix(int64(binary.LittleEndian.Uint64(plaintext)), 0)
+
+	if k.now().After(expires) {
+		return nil, nil, ErrTicketExpired
+	}
+
+	clientKey = plaintext[8 : 8+k.suite.DHLen()]
+	secret = plaintext[8+k.suite.DHLen():]
+
+	return clientKey, secret, nil
+}
+
+// Derives the secret a session can later be resumed from, independent
+// of the keys protecting its traffic.
+func resumptionSecret(
+	suite ciphersuite.Ciphersuite,
+	cv ciphersuite.ChainVariable,
+) (
+	secret ciphersuite.ChainVariable,
+) {
+	secret, _ = suite.DeriveCVCC(suite.NewChain(), ciphersuite.SymmetricKey(cv), kdfResumption)
+
+	return
+}
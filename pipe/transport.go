@@ -0,0 +1,82 @@
+package pipe
+
+import "encoding/binary"
+import "errors"
+import "io"
+import "time"
+
+const maxMessageLen = 1 << 16
+
+var (
+	ErrMessageTooLong = errors.New("noise/pipe: message exceeds maximum length")
+	ErrNoDeadline     = errors.New("noise/pipe: transport doesn't support deadlines")
+)
+
+// A MessageTransport carries discrete messages between the two sides
+// of a pipe, preserving their boundaries.
+type MessageTransport interface {
+	WriteMessage(msg []byte) error
+	ReadMessage() (msg []byte, err error)
+}
+
+type streamTransport struct {
+	rw io.ReadWriter
+}
+
+// NewStreamTransport returns a MessageTransport that frames messages
+// over a byte stream, prefixing each with its length as a 4-byte
+// little-endian integer.
+func NewStreamTransport(rw io.ReadWriter) MessageTransport {
+	return &streamTransport{rw: rw}
+}
+
+func (t *streamTransport) WriteMessage(msg []byte) error {
+	if len(msg) > maxMessageLen {
+		return ErrMessageTooLong
+	}
+
+	frame := make([]byte, 4+len(msg))
+
+	binary.LittleEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[4:], msg)
+
+	_, err := t.rw.Write(frame)
+
+	return err
+}
+
+func (t *streamTransport) ReadMessage() (msg []byte, err error) {
+	var prefix [4]byte
+
+	if _, err = io.ReadFull(t.rw, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	msgLen := binary.LittleEndian.Uint32(prefix[:])
+
+	if msgLen > maxMessageLen {
+		return nil, ErrMessageTooLong
+	}
+
+	msg = make([]byte, msgLen)
+
+	if _, err = io.ReadFull(t.rw, msg); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// SetDeadline sets the deadline on the underlying stream, if it
+// supports one.
+func (t *streamTransport) SetDeadline(deadline time.Time) error {
+	if d, ok := t.rw.(deadliner); ok {
+		return d.SetDeadline(deadline)
+	}
+
+	return ErrNoDeadline
+}